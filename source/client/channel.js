@@ -0,0 +1,125 @@
+/**
+ * Module xử lý channel (phòng chat)
+ */
+
+let currentChannel = "general";
+let joinedChannels = ["general"];
+let onlineByChannel = {};
+let offlineByChannel = {};
+
+/**
+ * Gửi một yêu cầu điều khiển (JSON) lên server qua unidirectional stream
+ */
+async function sendControlMessage(payload) {
+  if (!transport) return;
+  const stream = await transport.createUnidirectionalStream();
+  const writer = stream.getWriter();
+  await writer.write(new TextEncoder().encode(JSON.stringify(payload)));
+  await writer.close();
+}
+
+/**
+ * Xử lý danh sách channel server gửi về
+ */
+function handleChannelList(msg) {
+  joinedChannels = msg.joined || [];
+  if (!joinedChannels.includes(currentChannel)) {
+    switchChannel(joinedChannels[0] || "general");
+  }
+  renderChannelList(msg.channels || []);
+}
+
+function renderChannelList(channels) {
+  const listEl = document.getElementById("channel-list");
+  if (!listEl) return;
+
+  listEl.innerHTML = "";
+  channels.forEach((channel) => {
+    const item = document.createElement("div");
+    item.className = "channel-item";
+    if (channel.name === currentChannel) item.classList.add("active");
+    if (!channel.joined) item.classList.add("not-joined");
+
+    const label = document.createElement("span");
+    label.className = "channel-name";
+    label.textContent = `# ${channel.name}`;
+
+    const count = document.createElement("span");
+    count.className = "channel-online";
+    count.textContent = channel.online;
+
+    item.appendChild(label);
+    item.appendChild(count);
+
+    if (channel.joined) {
+      item.onclick = () => switchChannel(channel.name);
+      const leaveBtn = document.createElement("button");
+      leaveBtn.className = "channel-leave-btn";
+      leaveBtn.title = "Leave";
+      leaveBtn.innerHTML = '<i class="fas fa-times"></i>';
+      leaveBtn.onclick = (e) => {
+        e.stopPropagation();
+        sendControlMessage({ type: "channel_leave", channel: channel.name });
+      };
+      item.appendChild(leaveBtn);
+    } else {
+      item.title = "Click to join";
+      item.onclick = () => sendControlMessage({ type: "channel_join", channel: channel.name });
+    }
+
+    listEl.appendChild(item);
+  });
+}
+
+/**
+ * Chuyển channel đang xem
+ */
+function switchChannel(channelName) {
+  if (typingChannel && typingChannel !== channelName) {
+    stopTyping();
+  }
+  currentChannel = channelName;
+  const title = document.getElementById("chat-title-text");
+  if (title) title.textContent = `# ${channelName}`;
+  updateOnlineList(onlineByChannel[channelName] || [], offlineByChannel[channelName] || []);
+  renderTypingIndicator();
+  updateLoadHistoryButton();
+  markVisibleAsRead();
+  document.querySelectorAll(".channel-item").forEach((el) => {
+    el.classList.toggle("active", el.querySelector(".channel-name").textContent === `# ${channelName}`);
+  });
+}
+
+/**
+ * Tạo channel mới
+ */
+function createChannelPrompt() {
+  if (!transport) {
+    showNotification('Not connected to server!', 'error');
+    return;
+  }
+  const channelName = prompt("Channel name (letters, digits, - or _):");
+  if (!channelName) return;
+  sendControlMessage({ type: "channel_create", channel: channelName.trim() });
+}
+
+/**
+ * Lưu online list (kèm người đã rời và thời điểm last seen) theo channel và
+ * hiển thị nếu là channel đang xem
+ */
+function handleOnlineList(msg) {
+  const channelName = msg.channel || "general";
+  onlineByChannel[channelName] = msg.clients;
+  offlineByChannel[channelName] = msg.offline || [];
+  if (channelName === currentChannel) {
+    updateOnlineList(msg.clients, offlineByChannel[channelName]);
+  }
+}
+
+function resetChannels() {
+  onlineByChannel = {};
+  offlineByChannel = {};
+  joinedChannels = ["general"];
+  renderChannelList([]);
+  switchChannel("general");
+}
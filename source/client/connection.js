@@ -3,10 +3,25 @@
  */
 
 const baseUrl = "https://26.135.88.251:4433/chat";
+// Endpoint của server khi chạy với --dev-tls; đặt null nếu dùng chứng chỉ tin cậy (mkcert)
+const certHashUrl = "http://localhost:4434/cert-hash";
 let transport = null;
+let datagramWriter = null;
 let name = "";
+let clientId = null; // ID phiên do server cấp
 let isConnecting = false;
 
+// Phiên bản giao thức và các tính năng client hỗ trợ, gửi trong hello
+const PROTOCOL_VERSION = 2;
+const CLIENT_FEATURES = ["channels", "dm", "file_list_delta", "history", "presence", "receipts", "typing"];
+// Giới hạn server báo trong welcome (max_file_size, num_streams, chunk_size, ...)
+let serverLimits = {};
+let serverFeatures = [];
+
+// Byte đầu tiên của mỗi bidirectional stream cho server biết loại stream
+const STREAM_TYPE_FILE = 0x01;
+const STREAM_TYPE_DRAWING = 0x02;
+
 async function connect() {
   if (transport) return transport;
   if (isConnecting) return;
@@ -15,19 +30,28 @@ async function connect() {
   updateConnectionStatus('connecting', 'Connecting...');
 
   try {
-    transport = new WebTransport(`${baseUrl}?name=${encodeURIComponent(name)}`);
+    const options = await getTransportOptions();
+    transport = new WebTransport(buildChatUrl(), options);
     await transport.ready;
     console.log("Connected to server");
     
     updateConnectionStatus('connected', 'Connected');
     showNotification('Successfully connected to chat!', 'success');
 
-    transport.closed.then(() => {
-      console.log("Connection closed.");
+    transport.closed.then((info) => {
+      console.log("Connection closed.", info);
       updateUIOnDisconnect();
-      showNotification('Disconnected from server', 'error');
+      const reason = info && info.reason ? `: ${info.reason}` : '';
+      showNotification(`Disconnected from server${reason}`, 'error');
+    }).catch((error) => {
+      console.log("Connection closed with error:", error);
+      updateUIOnDisconnect();
+      showNotification('Connection lost', 'error');
     });
 
+    // Hello phải là unidirectional stream đầu tiên; server trả welcome trên persistent stream
+    await sendControlMessage({ type: "hello", protocol_version: PROTOCOL_VERSION, features: CLIENT_FEATURES });
+
     handleIncomingStreams(); 
     readDatagrams();
 
@@ -43,6 +67,46 @@ async function connect() {
   }
 }
 
+/**
+ * Tạo URL kết nối. Nếu server bật xác thực token, truyền token qua
+ * index.html?access_token=... (WebTransport không cho phép đặt header).
+ */
+function buildChatUrl() {
+  const params = new URLSearchParams({ name });
+  // Token định danh ẩn danh, giúp giữ channel đã tham gia khi kết nối lại
+  const resumeToken = sessionStorage.getItem("resumeToken");
+  if (resumeToken) {
+    params.set("resume", resumeToken);
+  }
+  const token = new URLSearchParams(window.location.search).get("access_token");
+  if (token) {
+    params.set("access_token", token);
+  }
+  return `${baseUrl}?${params.toString()}`;
+}
+
+/**
+ * Lấy hash chứng chỉ dev từ server để pin qua serverCertificateHashes.
+ * Nếu endpoint không khả dụng thì kết nối bình thường với chứng chỉ tin cậy.
+ */
+async function getTransportOptions() {
+  if (!certHashUrl) return {};
+  try {
+    const response = await fetch(certHashUrl, { cache: "no-store" });
+    if (!response.ok) return {};
+    const { hashes } = await response.json();
+    return {
+      serverCertificateHashes: hashes.map(h => ({
+        algorithm: h.algorithm,
+        value: Uint8Array.from(atob(h.value), c => c.charCodeAt(0))
+      }))
+    };
+  } catch (error) {
+    console.log("Dev certificate hash not available, using default TLS validation");
+    return {};
+  }
+}
+
 async function handleIncomingStreams() {
   const reader = transport.incomingUnidirectionalStreams.getReader();
   
@@ -57,7 +121,34 @@ async function handleIncomingStreams() {
 }
 
 /**
- * Đọc datagram từ server (online list và file list)
+ * Mở bidirectional stream và gửi byte loại stream
+ * @param {number} streamType - STREAM_TYPE_FILE hoặc STREAM_TYPE_DRAWING
+ * @returns {Promise<{stream: WebTransportBidirectionalStream, writer: WritableStreamDefaultWriter}>}
+ */
+async function openTypedStream(streamType) {
+  const stream = await transport.createBidirectionalStream();
+  const writer = stream.writable.getWriter();
+  await writer.write(new Uint8Array([streamType]));
+  return { stream, writer };
+}
+
+/**
+ * Gửi một datagram JSON (chỉ cho dữ liệu được phép mất, ví dụ typing)
+ */
+function sendDatagram(payload) {
+  if (!transport) return;
+  if (!datagramWriter) {
+    datagramWriter = transport.datagrams.writable.getWriter();
+  }
+  datagramWriter.write(new TextEncoder().encode(JSON.stringify(payload))).catch((err) => {
+    console.log("Failed to send datagram:", err);
+  });
+}
+
+/**
+ * Đọc datagram từ server. Datagram có thể mất hoặc đến sai thứ tự nên chỉ
+ * dùng cho dữ liệu tạm thời (typing); danh sách online và file list đi
+ * trên persistent stream.
  */
 async function readDatagrams() {
   const datagramReader = transport.datagrams.readable.getReader();
@@ -66,16 +157,9 @@ async function readDatagrams() {
     if (done) break;
     try {
       const text = new TextDecoder().decode(value);
-      console.log("Received datagram:", text);
-      
       const msg = JSON.parse(text);
-      
-      if (msg.type === "online") {
-        console.log("Online list update:", msg.clients);
-        updateOnlineList(msg.clients);
-      } else if (msg.type === "file_list") {
-        console.log("File list update:", msg.files);
-        updateAvailableFiles(msg.files);
+      if (msg.type === "typing") {
+        handleTypingEvent(msg);
       } else {
         console.log("Unknown datagram type:", msg.type);
       }
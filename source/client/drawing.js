@@ -89,28 +89,29 @@ async function sendDrawing() {
     const uint8Array = new Uint8Array(arrayBuffer);
 
     // Tạo stream để gửi
-    const stream = await transport.createBidirectionalStream();
-    const writer = stream.writable.getWriter();
+    const { stream, writer } = await openTypedStream(STREAM_TYPE_DRAWING);
     const encoder = new TextEncoder();
 
     // Gửi header với delimiter rõ ràng
     const headerObj = {
       op: "drawing",
       size: uint8Array.length,
-      format: "png"
+      format: "png",
+      channel: currentChannel
     };
     const headerJSON = JSON.stringify(headerObj);
+    const headerBytes = encoder.encode(headerJSON);
     
-    // Gửi độ dài header trước (4 bytes)
+    // Gửi độ dài header trước (4 bytes, tính theo byte UTF-8)
     const headerLengthBuffer = new ArrayBuffer(4);
     const headerLengthView = new DataView(headerLengthBuffer);
-    headerLengthView.setUint32(0, headerJSON.length, false);
+    headerLengthView.setUint32(0, headerBytes.length, false);
     await writer.write(new Uint8Array(headerLengthBuffer));
     console.log("Header length sent:", headerLengthBuffer, headerLengthView);
     
     console.log("Sending header:", headerJSON);
     // Gửi header JSON
-    await writer.write(encoder.encode(headerJSON));
+    await writer.write(headerBytes);
 
     // Gửi dữ liệu ảnh theo chunks để tránh block
     const CHUNK_SIZE = 64 * 1024;
@@ -181,9 +182,10 @@ async function sendDrawing() {
 }
 
 /**
- * Hiển thị bản vẽ nhận được trong chat
+ * Hiển thị bản vẽ nhận được trong chat. Bản vẽ trong history không kèm dữ
+ * liệu ảnh (data_omitted); khi đó hiển thị nút tải ảnh theo channel và id
  */
-function displayReceivedDrawing(sender, imageData) {
+function displayReceivedDrawing(sender, imageData, channel, id) {
   const messageDiv = document.createElement("div");
   messageDiv.className = "message drawing-message";
   
@@ -216,6 +218,53 @@ function displayReceivedDrawing(sender, imageData) {
   const drawingContainer = document.createElement("div");
   drawingContainer.className = "drawing-container";
 
+  if (imageData) {
+    drawingContainer.appendChild(createDrawingImage(imageData));
+  } else {
+    const loadBtn = document.createElement("button");
+    loadBtn.type = "button";
+    loadBtn.className = "load-history-btn";
+    loadBtn.textContent = "Load drawing";
+    loadBtn.onclick = () => {
+      loadBtn.disabled = true;
+      loadBtn.textContent = "Loading...";
+      sendControlMessage({ type: "drawing_data", channel: channel || "general", id });
+    };
+    drawingContainer.dataset.drawingId = id;
+    drawingContainer.appendChild(loadBtn);
+  }
+  messageBubble.appendChild(drawingContainer);
+  messageDiv.appendChild(messageBubble);
+
+  const messages = document.getElementById("messages");
+  messages.appendChild(messageDiv);
+  messages.scrollTop = messages.scrollHeight;
+}
+
+/**
+ * Hiển thị ảnh của bản vẽ đã tải theo yêu cầu ({type: 'drawing_data', id, data})
+ */
+function handleDrawingData(msg) {
+  const container = document.querySelector(`.drawing-container[data-drawing-id="${msg.id}"]`);
+  if (!container) return;
+  delete container.dataset.drawingId;
+  container.replaceChildren(createDrawingImage(msg.data));
+}
+
+/**
+ * Cho phép bấm lại các nút tải bản vẽ khi server báo lỗi
+ */
+function resetDrawingLoads() {
+  document.querySelectorAll(".drawing-container[data-drawing-id] button").forEach((btn) => {
+    btn.disabled = false;
+    btn.textContent = "Load drawing";
+  });
+}
+
+/**
+ * Tạo ảnh bản vẽ từ dữ liệu PNG base64, bấm vào để xem full size
+ */
+function createDrawingImage(imageData) {
   const img = document.createElement("img");
   img.className = "drawing-image";
   img.src = `data:image/png;base64,${imageData}`;
@@ -244,13 +293,7 @@ function displayReceivedDrawing(sender, imageData) {
     };
   };
 
-  drawingContainer.appendChild(img);
-  messageBubble.appendChild(drawingContainer);
-  messageDiv.appendChild(messageBubble);
-
-  const messages = document.getElementById("messages");
-  messages.appendChild(messageDiv);
-  messages.scrollTop = messages.scrollHeight;
+  return img;
 }
 
 /**
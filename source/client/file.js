@@ -3,8 +3,16 @@
  */
 
 let availableFiles = [];
-const NUM_STREAMS = 8; // Số stream song song
+// Tìm kiếm/sắp xếp đang áp dụng cho danh sách file ({q, sort, order}), null
+// khi hiện toàn bộ danh sách theo tên. Kết quả được server phân trang
+let fileQuery = null;
+let queriedFiles = [];
+let queriedTotal = 0;
+let fileQueryTimer = null;
+const FILE_PAGE_SIZE = 50;
+const NUM_STREAMS = 8; // Số stream song song mặc định cho download, server báo giá trị thật trong welcome
 const CHUNK_SIZE = 256 * 1024; // 256KB cho mỗi lần gửi (client-side chunking)
+const MIN_PART_SIZE = 1024 * 1024; // File nhỏ hơn 1MB chỉ cần một phần
 
 /**
  * Tính toán SHA-256 Hash của file
@@ -17,16 +25,120 @@ async function calculateFileHash(file) {
 }
 
 /**
- * Upload file lên server với multi-stream (parallel upload - optimized)
+ * Tính SHA-256 của từng phần, gửi trong manifest của begin và header upload
+ * để server kiểm tra khi nhận từng phần và khi merge
  */
-async function uploadFile(file) {
+async function calculatePartHashes(file, partSize) {
+  const hashes = [];
+  for (let start = 0; start < file.size; start += partSize) {
+    const buffer = await file.slice(start, start + partSize).arrayBuffer();
+    const hashBuffer = await crypto.subtle.digest('SHA-256', buffer);
+    hashes.push(Array.from(new Uint8Array(hashBuffer)).map(b => b.toString(16).padStart(2, '0')).join(''));
+  }
+  return hashes;
+}
+
+/**
+ * Kích thước mỗi phần: file nhỏ gửi một phần, file lớn chia cho num_streams stream
+ */
+function choosePartSize(size) {
+  const numStreams = serverLimits.num_streams || NUM_STREAMS;
+  return Math.max(MIN_PART_SIZE, Math.ceil(size / numStreams));
+}
+
+/**
+ * Chạy worker cho từng phần tử, tối đa `limit` worker cùng lúc
+ */
+async function runWithConcurrency(items, limit, worker) {
+  let next = 0;
+  const runners = Array.from({ length: Math.min(limit, items.length) }, async () => {
+    while (next < items.length) {
+      await worker(items[next++]);
+    }
+  });
+  await Promise.all(runners);
+}
+
+/**
+ * Gửi một yêu cầu file (begin, query, merge...) và đọc JSON response
+ */
+async function fileRequest(header) {
+  const { stream, writer } = await openTypedStream(STREAM_TYPE_FILE);
+  await writer.write(new TextEncoder().encode(JSON.stringify(header) + "\n"));
+  await writer.close();
+  return readJSONResponse(stream.readable);
+}
+
+/**
+ * Khóa localStorage lưu upload_id của một file, để upload bị gián đoạn
+ * (mất stream, mất kết nối, server khởi động lại) có thể tiếp tục
+ */
+function uploadResumeKey(file) {
+  return `upload:${file.name}:${file.size}:${file.lastModified}`;
+}
+
+/**
+ * Lấy upload session đang dở của file (nếu còn trên server) hoặc bắt đầu
+ * session mới với manifest (kích thước, kích thước phần, hash file và từng
+ * phần). Trả về trạng thái từng phần: { index, size, received } và hash
+ * từng phần (part_hashes) để gửi kèm header upload. Nếu server đã có nội
+ * dung cùng SHA-256, file được công bố ngay và kết quả có deduplicated.
+ */
+async function openUploadSession(file, fileHash, meta = {}) {
+  const key = uploadResumeKey(file);
+  const savedId = localStorage.getItem(key);
+  if (savedId) {
+    const status = await fileRequest({ op: "query", upload_id: savedId });
+    if (status.status === "ok") {
+      console.log(`Resuming upload ${savedId}:`, status.parts);
+      return { ...status, part_hashes: await calculatePartHashes(file, status.part_size) };
+    }
+    localStorage.removeItem(key);
+  }
+
+  const partSize = choosePartSize(file.size);
+  const partHashes = await calculatePartHashes(file, partSize);
+  const begin = await fileRequest({
+    op: "begin",
+    filename: file.name,
+    size: file.size,
+    part_size: partSize,
+    hash: fileHash,
+    part_hashes: partHashes,
+    description: meta.description,
+    tags: meta.tags,
+    channel: currentChannel
+  });
+  if (begin.status !== "ok") {
+    throw new Error(begin.error || "Failed to start upload");
+  }
+  if (begin.deduplicated) {
+    return begin;
+  }
+  localStorage.setItem(key, begin.upload_id);
+  const parts = [];
+  for (let i = 0; i < begin.num_parts; i++) {
+    const start = Math.min(i * begin.part_size, file.size);
+    const end = Math.min(start + begin.part_size, file.size);
+    parts.push({ index: i, size: end - start, received: 0 });
+  }
+  return { ...begin, parts, part_hashes: partHashes };
+}
+
+/**
+ * Upload file lên server với multi-stream (parallel upload - optimized).
+ * Mỗi phần được gửi tiếp từ offset server đã nhận nên upload bị gián đoạn
+ * chỉ cần gửi lại phần còn thiếu.
+ */
+async function uploadFile(file, meta = {}) {
   if (!transport) {
     showNotification('Not connected to server!', 'error');
     return;
   }
 
-  if (file.size > 100 * 1024 * 1024) {
-    showNotification('File too large! Maximum 100MB', 'error');
+  const maxFileSize = serverLimits.max_file_size || 100 * 1024 * 1024;
+  if (file.size > maxFileSize) {
+    showNotification(`File too large! Maximum ${formatFileSize(maxFileSize)}`, 'error');
     return;
   }
 
@@ -43,43 +155,51 @@ async function uploadFile(file) {
 
     const fileHash = await calculateFileHash(file);
 
-    progressText.textContent = `Uploading ${file.name} with ${NUM_STREAMS} streams...`;
-    progressBar.style.width = '20%';
-
-    // Chia file thành NUM_STREAMS chunks
-    const chunkSize = Math.ceil(file.size / NUM_STREAMS);
-    const chunks = [];
-    for (let i = 0; i < NUM_STREAMS; i++) {
-      const start = i * chunkSize;
-      const end = Math.min(start + chunkSize, file.size);
-      chunks.push({ index: i, start, end, blob: file.slice(start, end) });
+    const session = await openUploadSession(file, fileHash, meta);
+    if (session.deduplicated) {
+      // Server đã có nội dung này nên không cần gửi dữ liệu
+      progressBar.style.width = '100%';
+      progressText.textContent = 'Already on server, no data sent';
+      showNotification(`File uploaded as ${session.filename} (already stored on server)`, 'success');
+      setTimeout(() => {
+        progressContainer.style.display = 'none';
+        progressBar.style.width = '0%';
+      }, 1200);
+      return;
     }
+    const numStreams = Math.min(session.num_parts, serverLimits.num_streams || NUM_STREAMS);
+    const resumed = session.parts.reduce((sum, p) => sum + p.received, 0);
+
+    progressText.textContent = resumed > 0
+      ? `Resuming ${file.name} at ${formatFileSize(resumed)}...`
+      : `Uploading ${file.name} with ${numStreams} streams...`;
+    progressBar.style.width = '20%';
 
-    let uploadedBytes = 0;
     const startTime = performance.now();
-    const bytesLock = { value: 0 };
+    const bytesLock = { value: resumed };
     const speedSamples = [];
     let lastUpdate = startTime;
 
-    // Upload các chunks song song
-    const uploadPromises = chunks.map(async (chunk) => {
-      const stream = await transport.createBidirectionalStream();
-      const writer = stream.writable.getWriter();
+    // Gửi một phần từ offset, trả về số byte server đang giữ cho phần đó
+    const sendPart = async (part, offset) => {
+      const start = part.index * session.part_size;
+      const end = start + part.size;
+      const { stream, writer } = await openTypedStream(STREAM_TYPE_FILE);
       const encoder = new TextEncoder();
 
-      // Gửi header
+      // Gửi header kèm hash của cả phần; server kiểm tra khi nhận đủ và bỏ
+      // phần bị hỏng ngay (lần thử lại sẽ gửi lại từ đầu phần)
       const header = JSON.stringify({
         op: "upload",
-        filename: file.name,
-        size: chunk.end - chunk.start,
-        chunk_index: chunk.index,
-        chunk_start: chunk.start,
-        chunk_end: chunk.end
+        upload_id: session.upload_id,
+        chunk_index: part.index,
+        offset,
+        hash: session.part_hashes[part.index]
       }) + "\n";
       await writer.write(encoder.encode(header));
 
       // Stream chunk data với buffer lớn hơn
-      const reader = chunk.blob.stream().getReader();
+      const reader = file.slice(start + offset, end).stream().getReader();
       const buffer = [];
       let bufferSize = 0;
       const BUFFER_THRESHOLD = CHUNK_SIZE * 4; // 1MB buffer
@@ -97,6 +217,7 @@ async function uploadFile(file) {
             }
             await writer.write(merged);
             bytesLock.value += merged.length;
+            part.sent += merged.length;
           }
           break;
         }
@@ -114,6 +235,7 @@ async function uploadFile(file) {
           }
           await writer.write(merged);
           bytesLock.value += merged.length;
+          part.sent += merged.length;
 
           buffer.length = 0;
           bufferSize = 0;
@@ -121,9 +243,9 @@ async function uploadFile(file) {
           // Update progress (throttled)
           const now = performance.now();
           if (now - lastUpdate >= 100) { // Update mỗi 100ms
-            const percent = 20 + (bytesLock.value / file.size) * 70;
+            const percent = 20 + (bytesLock.value / (file.size || 1)) * 70;
             const elapsed = (now - startTime) / 1000;
-            const speed = (bytesLock.value / (1024 * 1024)) / (elapsed || 1);
+            const speed = ((bytesLock.value - resumed) / (1024 * 1024)) / (elapsed || 1);
 
             // Lưu speed samples để tính trung bình mượt hơn
             speedSamples.push(speed);
@@ -131,7 +253,7 @@ async function uploadFile(file) {
             const avgSpeed = speedSamples.reduce((a, b) => a + b, 0) / speedSamples.length;
 
             progressBar.style.width = `${percent.toFixed(1)}%`;
-            progressText.textContent = `Uploading... ${avgSpeed.toFixed(2)} MB/s (${NUM_STREAMS} streams)`;
+            progressText.textContent = `Uploading... ${avgSpeed.toFixed(2)} MB/s (${numStreams} streams)`;
             lastUpdate = now;
           }
         }
@@ -142,41 +264,74 @@ async function uploadFile(file) {
       // Đọc response
       const result = await readJSONResponse(stream.readable);
       if (result.status !== "ok") {
-        throw new Error(`Chunk ${chunk.index} failed: ${result.error}`);
+        throw new Error(`Chunk ${part.index} failed: ${result.error}`);
       }
-
-      console.log(`Chunk ${chunk.index} uploaded successfully`);
-      return result;
-    });
+      if (!result.complete) {
+        throw new Error(`Chunk ${part.index} incomplete: ${result.bytes} of ${part.size} bytes`);
+      }
+      return result.bytes;
+    };
+
+    // Upload các phần còn thiếu song song; phần lỗi được thử lại từ offset server báo
+    const MAX_ATTEMPTS = 3;
+    const uploadPart = async (part) => {
+      let received = part.received;
+      for (let attempt = 1; received < part.size; attempt++) {
+        part.sent = 0;
+        try {
+          received = await sendPart(part, received);
+        } catch (err) {
+          if (attempt >= MAX_ATTEMPTS || !transport) throw err;
+          console.warn(`Chunk ${part.index} attempt ${attempt} failed, resuming:`, err);
+          const status = await fileRequest({ op: "query", upload_id: session.upload_id });
+          if (status.status !== "ok") throw new Error(status.error);
+          // Bỏ phần đã gửi nhưng server chưa giữ khỏi tiến độ
+          const held = status.parts[part.index].received;
+          bytesLock.value -= part.sent - (held - received);
+          received = held;
+        }
+      }
+      console.log(`Chunk ${part.index} uploaded successfully`);
+    };
 
     // Đợi tất cả chunks upload xong
-    await Promise.all(uploadPromises);
+    await runWithConcurrency(session.parts, numStreams, uploadPart);
 
     progressBar.style.width = '90%';
     progressText.textContent = 'Merging chunks on server...';
 
     // Gửi yêu cầu merge
-    const mergeStream = await transport.createBidirectionalStream();
-    const mergeWriter = mergeStream.writable.getWriter();
-    const encoder = new TextEncoder();
-
-    const mergeHeader = JSON.stringify({
+    const merge = () => fileRequest({
       op: "merge",
-      filename: file.name,
-      hash: fileHash
-    }) + "\n";
-    await mergeWriter.write(encoder.encode(mergeHeader));
-    await mergeWriter.close();
-
-    const mergeResult = await readJSONResponse(mergeStream.readable);
+      upload_id: session.upload_id,
+      hash: fileHash,
+      channel: currentChannel
+    });
+    let mergeResult = await merge();
+
+    // Server bỏ các phần sai hash hoặc thiếu; gửi lại riêng các phần đó một lần
+    if (mergeResult.status !== "ok" && Array.isArray(mergeResult.incomplete)) {
+      progressText.textContent = `Resending ${mergeResult.incomplete.length} parts...`;
+      const status = await fileRequest({ op: "query", upload_id: session.upload_id });
+      if (status.status !== "ok") throw new Error(status.error);
+      const retry = mergeResult.incomplete.map((i) => status.parts[i]);
+      bytesLock.value -= retry.reduce((sum, p) => sum + p.size - p.received, 0);
+      await runWithConcurrency(retry, numStreams, uploadPart);
+      mergeResult = await merge();
+    }
 
     if (mergeResult.status === "ok") {
+      localStorage.removeItem(uploadResumeKey(file));
       progressBar.style.width = '100%';
       const totalTime = (performance.now() - startTime) / 1000;
-      const avgSpeed = (file.size / (1024 * 1024)) / totalTime;
+      const avgSpeed = ((file.size - resumed) / (1024 * 1024)) / totalTime;
       progressText.textContent = `Upload successful! (${avgSpeed.toFixed(2)} MB/s)`;
-      showNotification(`File uploaded: ${file.name}`, 'success');
+      const published = mergeResult.filename || file.name;
+      showNotification(published === file.name ? `File uploaded: ${file.name}` : `File uploaded as ${published}`, 'success');
     } else {
+      if (mergeResult.error === "file hash mismatch") {
+        localStorage.removeItem(uploadResumeKey(file));
+      }
       throw new Error(`Merge failed: ${mergeResult.error}`);
     }
 
@@ -192,7 +347,8 @@ async function uploadFile(file) {
   } catch (e) {
     progressContainer.style.display = 'none';
     progressBar.style.width = '0%';
-    showNotification(`Upload failed: ${e.message}`, 'error');
+    const hint = localStorage.getItem(uploadResumeKey(file)) ? ' (select the file again to resume)' : '';
+    showNotification(`Upload failed: ${e.message}${hint}`, 'error');
     console.error("Upload error:", e);
   } finally {
     uploadBtn.disabled = false;
@@ -201,16 +357,17 @@ async function uploadFile(file) {
 }
 
 /**
- * Download file từ server với multi-stream (parallel download - optimized)
+ * Download file từ server với multi-stream (parallel download - optimized).
+ * version = 0 tải bản hiện tại, nếu không thì tải bản cũ có số version đó.
  */
-async function downloadFile(filename) {
+async function downloadFile(filename, version = 0) {
   if (!transport) {
     showNotification('Not connected to server!', 'error');
     return;
   }
 
   try {
-    showNotification(`Downloading ${filename} with ${NUM_STREAMS} streams...`, 'info');
+    showNotification(`Downloading ${filename} with ${serverLimits.num_streams || NUM_STREAMS} streams...`, 'info');
 
     const bar = document.getElementById('upload-progress-bar');
     const text = document.getElementById('upload-progress-text');
@@ -220,13 +377,13 @@ async function downloadFile(filename) {
     text.textContent = 'Getting file info...';
 
     // 1. Lấy metadata file (size, num_streams)
-    const metaStream = await transport.createBidirectionalStream();
-    const metaWriter = metaStream.writable.getWriter();
+    const { stream: metaStream, writer: metaWriter } = await openTypedStream(STREAM_TYPE_FILE);
     const encoder = new TextEncoder();
 
     const metaHeader = JSON.stringify({
       op: "download",
       filename: filename,
+      version: version,
       chunk_index: -1 // Request metadata
     }) + "\n";
     await metaWriter.write(encoder.encode(metaHeader));
@@ -261,13 +418,14 @@ async function downloadFile(filename) {
 
     // 3. Download các chunks song song
     const downloadPromises = chunks.map(async (chunk) => {
-      const stream = await transport.createBidirectionalStream();
-      const writer = stream.writable.getWriter();
+      const { stream, writer } = await openTypedStream(STREAM_TYPE_FILE);
 
-      // Gửi request cho chunk cụ thể
+      // Gửi request cho chunk cụ thể, cố định version từ metadata để không
+      // trộn dữ liệu nếu có người upload bản mới trong lúc đang tải
       const header = JSON.stringify({
         op: "download",
         filename: filename,
+        version: metadata.version,
         chunk_index: chunk.index,
         chunk_start: chunk.start,
         chunk_end: chunk.end
@@ -419,6 +577,79 @@ function updateAvailableFiles(files) {
     availableFiles = [];
   }
   console.log("Processed file list:", availableFiles);
+  refreshFileList();
+}
+
+/**
+ * Áp dụng thay đổi của danh sách file (file_list_delta): xóa các file trong
+ * removed, thêm hoặc cập nhật các file trong files
+ */
+function applyFileListDelta(delta) {
+  const removed = new Set(delta.removed || []);
+  availableFiles = availableFiles.filter(f => !removed.has(f.name));
+  (delta.files || []).forEach(file => {
+    const i = availableFiles.findIndex(f => f.name === file.name);
+    if (i >= 0) {
+      availableFiles[i] = file;
+    } else {
+      availableFiles.push(file);
+    }
+  });
+  refreshFileList();
+}
+
+/**
+ * Vẽ lại danh sách file sau khi nó thay đổi; nếu đang tìm kiếm/sắp xếp thì
+ * hỏi lại server các trang đã tải
+ */
+function refreshFileList() {
+  if (fileQuery) {
+    requestFilePage(0, Math.max(queriedFiles.length, FILE_PAGE_SIZE));
+  } else {
+    renderFileList();
+  }
+}
+
+/**
+ * Đọc ô tìm kiếm và kiểu sắp xếp, rồi hỏi server trang đầu tiên (chờ người
+ * dùng ngừng gõ một chút)
+ */
+function onFileQueryChange() {
+  const q = document.getElementById('file-search').value.trim();
+  const [sort, order] = document.getElementById('file-sort').value.split(':');
+  clearTimeout(fileQueryTimer);
+  if (!q && sort === 'name' && order === 'asc') {
+    fileQuery = null;
+    renderFileList();
+    return;
+  }
+  fileQuery = { q, sort, order };
+  fileQueryTimer = setTimeout(() => requestFilePage(0), 250);
+}
+
+/**
+ * Tìm theo một tag
+ */
+function searchFileTag(tag) {
+  document.getElementById('file-search').value = tag;
+  onFileQueryChange();
+}
+
+function requestFilePage(offset, limit = FILE_PAGE_SIZE) {
+  if (!fileQuery) return;
+  sendControlMessage({ type: "files", ...fileQuery, offset, limit });
+}
+
+/**
+ * Xử lý một trang danh sách file server trả về cho yêu cầu "files". Trang
+ * của truy vấn cũ (người dùng đã gõ tiếp) bị bỏ qua
+ */
+function handleFilePage(msg) {
+  if (!fileQuery || msg.q !== fileQuery.q || msg.sort !== fileQuery.sort || msg.order !== fileQuery.order) {
+    return;
+  }
+  queriedFiles = msg.offset === 0 ? msg.files : queriedFiles.concat(msg.files);
+  queriedTotal = msg.total;
   renderFileList();
 }
 
@@ -426,23 +657,27 @@ function renderFileList() {
   const fileListEl = document.getElementById('available-files-list');
   if (!fileListEl) return;
 
-  if (availableFiles.length === 0) {
+  const files = fileQuery ? queriedFiles : availableFiles;
+  if (files.length === 0) {
     fileListEl.innerHTML = `
       <div class="has-text-centered has-text-grey" style="padding: 2rem;">
         <i class="fas fa-folder-open fa-2x" style="opacity: 0.3;"></i>
-        <p style="margin-top: 10px;">No files available</p>
+        <p style="margin-top: 10px;">${fileQuery ? 'No matching files' : 'No files available'}</p>
       </div>`;
     return;
   }
 
   fileListEl.innerHTML = '';
-  availableFiles.forEach(file => {
+  files.forEach(file => {
     const fileDiv = document.createElement('div');
     fileDiv.className = 'file-item';
 
     const fileIcon = document.createElement('div');
     fileIcon.className = 'file-icon';
-    fileIcon.innerHTML = getFileIcon(file.name);
+    fileIcon.innerHTML = getFileIcon(file.name, file.mime);
+    if (file.mime) {
+      fileIcon.title = file.mime;
+    }
 
     const fileInfo = document.createElement('div');
     fileInfo.className = 'file-info';
@@ -455,9 +690,40 @@ function renderFileList() {
     const fileSize = document.createElement('div');
     fileSize.className = 'file-size';
     fileSize.textContent = formatFileSize(file.size);
+    if (file.versions > 1) {
+      fileSize.textContent += ` · v${file.version} (${file.versions} versions)`;
+    }
+    if (file.uploader) {
+      fileSize.textContent += ` · ${file.uploader}`;
+    }
+    if (file.time) {
+      fileSize.textContent += ` · ${new Date(file.time).toLocaleString()}`;
+    }
+    if (file.sha256) {
+      fileSize.title = `SHA-256: ${file.sha256}`;
+    }
 
     fileInfo.appendChild(fileName);
     fileInfo.appendChild(fileSize);
+    if (file.description) {
+      const description = document.createElement('div');
+      description.className = 'file-description';
+      description.textContent = file.description;
+      description.title = file.description;
+      fileInfo.appendChild(description);
+    }
+    if (file.tags && file.tags.length > 0) {
+      const tags = document.createElement('div');
+      tags.className = 'file-tags';
+      file.tags.forEach(tag => {
+        const chip = document.createElement('span');
+        chip.className = 'file-tag';
+        chip.textContent = tag;
+        chip.onclick = () => searchFileTag(tag);
+        tags.appendChild(chip);
+      });
+      fileInfo.appendChild(tags);
+    }
 
     const downloadBtn = document.createElement('button');
     downloadBtn.className = 'file-download-btn';
@@ -467,12 +733,124 @@ function renderFileList() {
 
     fileDiv.appendChild(fileIcon);
     fileDiv.appendChild(fileInfo);
+    if (file.versions > 1) {
+      const historyBtn = document.createElement('button');
+      historyBtn.className = 'file-download-btn file-history-btn';
+      historyBtn.innerHTML = '<i class="fas fa-history"></i>';
+      historyBtn.title = 'Versions';
+      historyBtn.onclick = () => toggleFileVersions(file.name, fileDiv);
+      fileDiv.appendChild(historyBtn);
+    }
+    const renameBtn = document.createElement('button');
+    renameBtn.className = 'file-download-btn file-history-btn';
+    renameBtn.innerHTML = '<i class="fas fa-pen"></i>';
+    renameBtn.title = 'Rename';
+    renameBtn.onclick = () => renameSharedFile(file.name);
+    fileDiv.appendChild(renameBtn);
+
+    const deleteBtn = document.createElement('button');
+    deleteBtn.className = 'file-download-btn file-history-btn file-delete-btn';
+    deleteBtn.innerHTML = '<i class="fas fa-trash"></i>';
+    deleteBtn.title = 'Delete';
+    deleteBtn.onclick = () => deleteSharedFile(file.name);
+    fileDiv.appendChild(deleteBtn);
+
     fileDiv.appendChild(downloadBtn);
     fileListEl.appendChild(fileDiv);
   });
+
+  if (fileQuery && queriedFiles.length < queriedTotal) {
+    const moreBtn = document.createElement('button');
+    moreBtn.className = 'button is-small is-fullwidth file-more-btn';
+    moreBtn.textContent = `Load more (${queriedTotal - queriedFiles.length} left)`;
+    moreBtn.onclick = () => requestFilePage(queriedFiles.length);
+    fileListEl.appendChild(moreBtn);
+  }
 }
 
-function getFileIcon(filename) {
+/**
+ * Hiện/ẩn danh sách version của một file ngay dưới file đó
+ */
+async function toggleFileVersions(filename, fileDiv) {
+  const next = fileDiv.nextElementSibling;
+  if (next && next.classList.contains('file-versions')) {
+    next.remove();
+    return;
+  }
+
+  try {
+    const result = await fileRequest({ op: "versions", filename });
+    if (result.status !== "ok") {
+      throw new Error(result.error);
+    }
+
+    const list = document.createElement('div');
+    list.className = 'file-versions';
+    result.versions.forEach(v => {
+      const row = document.createElement('div');
+      row.className = 'file-version';
+
+      const label = document.createElement('span');
+      const who = v.uploader ? ` · ${v.uploader}` : '';
+      const current = v.version === result.current ? ' (current)' : '';
+      label.textContent = `v${v.version}${current}${who} · ${new Date(v.time).toLocaleString()} · ${formatFileSize(v.size)}`;
+      if (v.sha256) {
+        label.title = `SHA-256: ${v.sha256}`;
+      }
+
+      const btn = document.createElement('button');
+      btn.className = 'file-version-download';
+      btn.innerHTML = '<i class="fas fa-download"></i>';
+      btn.title = `Download v${v.version}`;
+      btn.onclick = () => downloadFile(filename, v.version);
+
+      row.appendChild(label);
+      row.appendChild(btn);
+      list.appendChild(row);
+    });
+    fileDiv.after(list);
+  } catch (e) {
+    showNotification(`Cannot load versions: ${e.message}`, 'error');
+  }
+}
+
+/**
+ * Đổi tên một file chia sẻ. Mặc định chỉ người upload hoặc admin được phép;
+ * server báo lỗi nếu không có quyền
+ */
+async function renameSharedFile(filename) {
+  const newName = prompt("New file name:", filename);
+  if (!newName || newName === filename) return;
+
+  try {
+    const result = await fileRequest({ op: "rename", filename, new_name: newName, channel: currentChannel });
+    if (result.status !== "ok") {
+      throw new Error(result.error);
+    }
+    showNotification(`Renamed ${filename} to ${result.new_name}`, 'success');
+  } catch (e) {
+    showNotification(`Cannot rename ${filename}: ${e.message}`, 'error');
+  }
+}
+
+/**
+ * Xóa một file chia sẻ cùng mọi version của nó
+ */
+async function deleteSharedFile(filename) {
+  if (!confirm(`Delete ${filename} and all its versions?`)) return;
+
+  try {
+    const result = await fileRequest({ op: "delete", filename, channel: currentChannel });
+    if (result.status !== "ok") {
+      throw new Error(result.error);
+    }
+    showNotification(`Deleted ${filename}`, 'success');
+  } catch (e) {
+    showNotification(`Cannot delete ${filename}: ${e.message}`, 'error');
+  }
+}
+
+function getFileIcon(filename, mime = '') {
   const ext = filename.split('.').pop().toLowerCase();
   const map = {
     pdf: 'fa-file-pdf', doc: 'fa-file-word', docx: 'fa-file-word',
@@ -482,7 +860,10 @@ function getFileIcon(filename) {
     zip: 'fa-file-archive', rar: 'fa-file-archive',
     txt: 'fa-file-alt', mp3: 'fa-file-audio', mp4: 'fa-file-video'
   };
-  const icon = map[ext] || 'fa-file';
+  const byType = {
+    image: 'fa-file-image', audio: 'fa-file-audio', video: 'fa-file-video', text: 'fa-file-alt'
+  };
+  const icon = map[ext] || byType[mime.split('/')[0]] || 'fa-file';
   return `<i class="fas ${icon}"></i>`;
 }
 
@@ -507,6 +888,10 @@ function handleFileSelect() {
       <button onclick="clearFileSelection()" class="clear-btn">
         <i class="fas fa-times"></i>
       </button>
+    </div>
+    <div class="selected-file-meta">
+      <input type="text" id="file-description" class="input is-small" maxlength="500" placeholder="Description (optional)">
+      <input type="text" id="file-tags" class="input is-small" placeholder="Tags, comma separated (optional)">
     </div>`;
   selectedFileInfo.style.display = 'block';
   
@@ -540,7 +925,11 @@ async function handleFileUpload(event) {
     return false;
   }
 
-  await uploadFile(file);
+  const meta = {
+    description: document.getElementById('file-description').value.trim(),
+    tags: document.getElementById('file-tags').value.split(',').map(t => t.trim()).filter(Boolean)
+  };
+  await uploadFile(file, meta);
   clearFileSelection();
   return false;
 }
\ No newline at end of file
@@ -0,0 +1,73 @@
+/**
+ * Module lịch sử chat: hiển thị backfill khi join và tải tin nhắn cũ hơn
+ */
+
+// ID các sự kiện đã hiển thị, để không lặp lại khi kết nối lại
+const seenEventIds = new Set();
+// ID sự kiện cũ nhất đã tải của mỗi channel, dùng để phân trang
+let oldestEventId = {};
+let hasMoreHistory = {};
+
+/**
+ * Ghi nhận một sự kiện đã lưu trong history (có id và time do server cấp);
+ * trả về false nếu sự kiện đã được hiển thị trước đó
+ */
+function markEventSeen(msg) {
+  if (msg.id === undefined || msg.time === undefined) return true;
+  if (seenEventIds.has(msg.id)) return false;
+  seenEventIds.add(msg.id);
+  const channel = msg.channel || "general";
+  if (oldestEventId[channel] === undefined || msg.id < oldestEventId[channel]) {
+    oldestEventId[channel] = msg.id;
+  }
+  return true;
+}
+
+/**
+ * Xử lý phản hồi history từ server
+ */
+function handleHistory(msg) {
+  const channel = msg.channel || "general";
+  const messages = document.getElementById("messages");
+  const events = msg.messages || [];
+
+  // Trang cũ hơn được chèn lên đầu khung chat, backfill khi join thì nối vào cuối
+  const prepend = msg.before_id > 0;
+  const firstChild = messages.firstChild;
+  const countBefore = messages.children.length;
+
+  events.forEach((event) => handleStreamEvent(event));
+
+  if (prepend) {
+    const added = Array.from(messages.children).slice(countBefore);
+    added.forEach((el) => messages.insertBefore(el, firstChild));
+    messages.scrollTop = 0;
+  }
+
+  hasMoreHistory[channel] = msg.has_more;
+  updateLoadHistoryButton();
+}
+
+/**
+ * Yêu cầu trang lịch sử cũ hơn của channel đang xem
+ */
+function loadEarlierMessages() {
+  if (!transport) return;
+  const payload = { type: "history", channel: currentChannel };
+  if (oldestEventId[currentChannel] !== undefined) {
+    payload.before_id = oldestEventId[currentChannel];
+  }
+  sendControlMessage(payload);
+}
+
+function updateLoadHistoryButton() {
+  const btn = document.getElementById("load-history-btn");
+  if (!btn) return;
+  btn.style.display = transport && hasMoreHistory[currentChannel] ? "" : "none";
+}
+
+function resetHistory() {
+  oldestEventId = {};
+  hasMoreHistory = {};
+  updateLoadHistoryButton();
+}
@@ -12,47 +12,180 @@ async function sendMessage(event) {
   const message = msgInput.value.trim();
   if (!message || !transport) return;
 
+  let payload = { type: "chat", name, message, channel: currentChannel };
+  if (message.startsWith("/msg ")) {
+    payload = parseDirectMessage(message);
+    if (!payload) {
+      showNotification('Usage: /msg <name> <message> (quote names with spaces)', 'error');
+      return;
+    }
+  }
+
   try {
     const encoder = new TextEncoder();
     const stream = await transport.createUnidirectionalStream(); 
     const writer = stream.getWriter();
-    await writer.write(encoder.encode(JSON.stringify({ type: "chat", name, message })));
+    await writer.write(encoder.encode(JSON.stringify(payload)));
     await writer.close();
     msgInput.value = "";
     console.log("Sent message:", message);
-    hideTypingIndicator();
+    stopTyping();
   } catch (error) {
     console.error("Failed to send message:", error);
     showNotification('Failed to send message', 'error');
   }
 }
 
+/**
+ * Phân tích lệnh `/msg <tên> <nội dung>` thành tin nhắn riêng.
+ * Tên có khoảng trắng được đặt trong dấu nháy kép, ví dụ `/msg "An (2)" chào`.
+ */
+function parseDirectMessage(text) {
+  const match = text.match(/^\/msg\s+(?:"([^"]+)"|(\S+))\s+([\s\S]+)$/);
+  if (!match) return null;
+  return { type: "dm", to: [match[1] || match[2]], message: match[3].trim() };
+}
+
+/**
+ * Điền sẵn lệnh nhắn riêng cho một người dùng vào ô nhập
+ */
+function startDirectMessage(userName) {
+  const msgInput = document.getElementById("message");
+  const target = /\s/.test(userName) ? `"${userName}"` : userName;
+  msgInput.value = `/msg ${target} `;
+  msgInput.focus();
+}
+
+/**
+ * Xử lý một sự kiện server gửi trên persistent stream (hoặc trong history)
+ */
+function handleStreamEvent(msg) {
+    if (!markEventSeen(msg)) return;
+
+    if (msg.type === "welcome") {
+        serverLimits = msg.limits || {};
+        serverFeatures = msg.features || [];
+        console.log(`Protocol v${msg.protocol_version}, features:`, serverFeatures, "limits:", serverLimits);
+    } else if (msg.type === "identity") {
+        // Server có thể thêm hậu tố nếu tên đã được dùng, ví dụ "An (2)"
+        clientId = msg.id;
+        name = msg.name;
+        document.getElementById("name").value = msg.name;
+        if (msg.resume_token) {
+            sessionStorage.setItem("resumeToken", msg.resume_token);
+        }
+    } else if (msg.type === "channels") {
+        handleChannelList(msg);
+    } else if (msg.type === "online") {
+        handleOnlineList(msg);
+    } else if (msg.type === "file_list") {
+        updateAvailableFiles(msg.files);
+    } else if (msg.type === "file_list_delta") {
+        applyFileListDelta(msg);
+    } else if (msg.type === "files") {
+        handleFilePage(msg);
+    } else if (msg.type === "history") {
+        handleHistory(msg);
+    } else if (msg.type === "error") {
+        if (msg.request === "drawing_data") resetDrawingLoads();
+        showNotification(msg.error, 'error');
+    } else if (msg.type === "receipt") {
+        handleReceipt(msg);
+    } else if (msg.type === "chat") {
+        applyEventMeta(addMessageElement(msg.name, msg.message, msg.channel), msg);
+        acknowledgeEvent(msg);
+    } else if (msg.type === "dm") {
+        const recipients = msg.to.map((r) => r.name).join(", ");
+        const label = msg.sender_id === clientId ? `private to ${recipients}` : "private";
+        applyEventMeta(addMessageElement(msg.name, msg.message, null, label), msg);
+        acknowledgeEvent(msg);
+    } else if (msg.type === "system") {
+        addMessageElement("SYSTEM", msg.message, msg.channel);
+    } else if (msg.type === "file") {
+        // Hiển thị thông báo file mới
+        addFileNotification(msg.name, msg.filename, msg.size);
+        acknowledgeEvent(msg);
+    } else if (msg.type === "drawing") {
+        displayReceivedDrawing(msg.name, msg.data, msg.channel, msg.id);
+        acknowledgeEvent(msg);
+    } else if (msg.type === "drawing_data") {
+        handleDrawingData(msg);
+    }
+}
+
+/**
+ * Tách các frame (4 byte độ dài big-endian + JSON) từ các chunk đọc được.
+ * QUIC có thể gộp hoặc chia nhỏ các lần ghi, nên không thể coi mỗi chunk
+ * là một tin nhắn.
+ */
+class FrameDecoder {
+  constructor() {
+    this.chunks = [];
+    this.length = 0;        // số byte đang chờ trong chunks
+    this.frameLength = -1;  // độ dài payload của frame đang đọc, -1 nếu chưa có header
+  }
+
+  /**
+   * Thêm một chunk và trả về payload của các frame đã đủ dữ liệu
+   */
+  push(chunk) {
+    this.chunks.push(chunk);
+    this.length += chunk.length;
+
+    const frames = [];
+    while (true) {
+      if (this.frameLength < 0) {
+        if (this.length < 4) break;
+        this.frameLength = new DataView(this.take(4).buffer).getUint32(0);
+      }
+      if (this.length < this.frameLength) break;
+      frames.push(this.take(this.frameLength));
+      this.frameLength = -1;
+    }
+    return frames;
+  }
+
+  /**
+   * Lấy n byte đầu tiên ra khỏi hàng đợi, mỗi byte chỉ được copy một lần
+   */
+  take(n) {
+    const out = new Uint8Array(n);
+    let filled = 0;
+    while (filled < n) {
+      const chunk = this.chunks[0];
+      const count = Math.min(chunk.length, n - filled);
+      out.set(chunk.subarray(0, count), filled);
+      filled += count;
+      if (count === chunk.length) {
+        this.chunks.shift();
+      } else {
+        this.chunks[0] = chunk.subarray(count);
+      }
+    }
+    this.length -= n;
+    return out;
+  }
+}
+
 /**
  * Đọc tin nhắn liên tục từ Stream vĩnh viễn
  */
 async function readContinuousMessages(stream) {
-    const decoder = new TextDecoderStream("utf-8");
-    const reader = stream.pipeThrough(decoder).getReader();
+    const reader = stream.getReader();
+    const frames = new FrameDecoder();
+    const decoder = new TextDecoder("utf-8");
 
     while (true) {
         const { value, done } = await reader.read();
         if (done) break;
-        
-        try {
-            const msg = JSON.parse(value);
-            
-            if (msg.type === "chat") {
-                addMessageElement(msg.name, msg.message);
-            } else if (msg.type === "system") {
-                addMessageElement("SYSTEM", msg.message);
-            } else if (msg.type === "file") {
-                // Hiển thị thông báo file mới
-                addFileNotification(msg.name, msg.filename, msg.size);
-            } else if (msg.type === "drawing") {
-                displayReceivedDrawing(msg.name, msg.data);
+
+        for (const payload of frames.push(value)) {
+            const text = decoder.decode(payload);
+            try {
+                handleStreamEvent(JSON.parse(text));
+            } catch(e) {
+                console.error("Failed to parse JSON from continuous stream:", e, "Data received:", text);
             }
-        } catch(e) {
-            console.error("Failed to parse JSON from continuous stream:", e, "Data received:", value);
         }
     }
     console.log("Persistent message stream closed.");
@@ -0,0 +1,136 @@
+/**
+ * Module trạng thái (online/away/busy) và chỉ báo đang nhập
+ */
+
+const PRESENCE_LABELS = { online: "Online", away: "Away", busy: "Busy" };
+
+// Gửi lại "start" định kỳ khi đang nhập; server tự hết hạn nếu không được gia hạn
+const TYPING_RENEW_MS = 2000;
+// Ngừng nhập quá lâu thì gửi "stop"
+const TYPING_IDLE_MS = 3000;
+
+let typingChannel = null; // channel đang báo "đang nhập", null nếu không nhập
+let lastTypingSent = 0;
+let typingIdleTimeout = null;
+// channel -> (user id -> { name, timer }) của những người khác đang nhập
+let typingByChannel = {};
+
+/**
+ * Gửi trạng thái và status text đang chọn lên server
+ */
+function sendPresence() {
+  const state = document.getElementById("presence-state").value;
+  const status = document.getElementById("presence-status").value.trim();
+  sendControlMessage({ type: "presence", state, status });
+}
+
+/**
+ * Nhãn trạng thái hiển thị dưới tên người dùng
+ */
+function presenceLabel(user) {
+  const label = PRESENCE_LABELS[user.presence] || "Online";
+  return user.status ? `${label} · ${user.status}` : label;
+}
+
+/**
+ * Nhãn "last seen" cho người đã rời đi
+ */
+function lastSeenLabel(lastSeen) {
+  const time = new Date(lastSeen);
+  const sameDay = time.toDateString() === new Date().toDateString();
+  return `Last seen ${sameDay ? time.toLocaleTimeString() : time.toLocaleString()}`;
+}
+
+/**
+ * Gọi mỗi khi người dùng gõ phím trong ô nhập tin nhắn
+ */
+function notifyTyping() {
+  if (!transport) return;
+  const now = Date.now();
+  if (typingChannel !== currentChannel || now - lastTypingSent > TYPING_RENEW_MS) {
+    if (typingChannel && typingChannel !== currentChannel) {
+      stopTyping();
+    }
+    sendDatagram({ type: "typing", channel: currentChannel, state: "start" });
+    typingChannel = currentChannel;
+    lastTypingSent = now;
+  }
+
+  clearTimeout(typingIdleTimeout);
+  typingIdleTimeout = setTimeout(stopTyping, TYPING_IDLE_MS);
+}
+
+/**
+ * Báo server là đã ngừng nhập (khi gửi tin, đổi channel hoặc ngừng gõ)
+ */
+function stopTyping() {
+  clearTimeout(typingIdleTimeout);
+  if (!typingChannel) return;
+  if (transport) {
+    sendDatagram({ type: "typing", channel: typingChannel, state: "stop" });
+  }
+  typingChannel = null;
+  lastTypingSent = 0;
+}
+
+/**
+ * Xử lý datagram typing từ server. Datagram có thể bị mất nên mỗi "start"
+ * chỉ có hiệu lực trong expires_in ms nếu không được gia hạn.
+ */
+function handleTypingEvent(msg) {
+  if (!msg.user || msg.user.id === clientId) return;
+  const users = typingByChannel[msg.channel] || (typingByChannel[msg.channel] = {});
+  const existing = users[msg.user.id];
+  if (existing) {
+    clearTimeout(existing.timer);
+    delete users[msg.user.id];
+  }
+
+  if (msg.state === "start") {
+    users[msg.user.id] = {
+      name: msg.user.name,
+      timer: setTimeout(() => {
+        delete users[msg.user.id];
+        renderTypingIndicator();
+      }, msg.expires_in || 6000)
+    };
+  }
+  renderTypingIndicator();
+}
+
+/**
+ * Hiển thị ai đang nhập trong channel đang xem
+ */
+function renderTypingIndicator() {
+  const indicator = document.getElementById("typing-indicator");
+  if (!indicator) return;
+
+  const names = Object.values(typingByChannel[currentChannel] || {}).map((u) => u.name);
+  if (names.length === 0) {
+    indicator.style.display = "none";
+    return;
+  }
+  let text;
+  if (names.length === 1) {
+    text = `${names[0]} is typing...`;
+  } else if (names.length <= 3) {
+    text = `${names.join(", ")} are typing...`;
+  } else {
+    text = "Several people are typing...";
+  }
+  indicator.textContent = text;
+  indicator.style.display = "block";
+}
+
+function resetPresence() {
+  clearTimeout(typingIdleTimeout);
+  typingChannel = null;
+  lastTypingSent = 0;
+  Object.values(typingByChannel).forEach((users) => {
+    Object.values(users).forEach((u) => clearTimeout(u.timer));
+  });
+  typingByChannel = {};
+  renderTypingIndicator();
+  document.getElementById("presence-state").value = "online";
+  document.getElementById("presence-status").value = "";
+}
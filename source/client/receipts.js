@@ -0,0 +1,114 @@
+/**
+ * Module xác nhận đã nhận / đã đọc tin nhắn (delivery & read receipts)
+ */
+
+const ACK_DELAY_MS = 300;
+
+let pendingAcks = { delivered: [], read: [] };
+let ackTimer = null;
+// ID tin nhắn đã nhận nhưng chưa đọc, theo channel ("" là tin nhắn riêng)
+let unreadByChannel = {};
+// Người đã nhận / đã đọc mỗi tin nhắn của mình: id -> { delivered: Set, read: Set }
+const receiptsById = {};
+
+/**
+ * Ghi nhận một sự kiện từ người khác và lên lịch gửi ack
+ */
+function acknowledgeEvent(msg) {
+  if (msg.id === undefined || msg.sender_id === undefined || msg.sender_id === clientId) return;
+
+  const channel = msg.type === "dm" ? "" : (msg.channel || "general");
+  if (isChannelVisible(channel)) {
+    queueAck("read", msg.id);
+  } else {
+    queueAck("delivered", msg.id);
+    (unreadByChannel[channel] = unreadByChannel[channel] || []).push(msg.id);
+  }
+}
+
+function isChannelVisible(channel) {
+  return document.visibilityState === "visible" && (channel === "" || channel === currentChannel);
+}
+
+function queueAck(status, id) {
+  pendingAcks[status].push(id);
+  if (!ackTimer) {
+    ackTimer = setTimeout(flushAcks, ACK_DELAY_MS);
+  }
+}
+
+function flushAcks() {
+  ackTimer = null;
+  for (const status of ["delivered", "read"]) {
+    const ids = pendingAcks[status];
+    pendingAcks[status] = [];
+    // Server nhận tối đa 200 id mỗi ack
+    for (let i = 0; i < ids.length; i += 200) {
+      sendControlMessage({ type: "ack", status, ids: ids.slice(i, i + 200) });
+    }
+  }
+}
+
+/**
+ * Đánh dấu đã đọc các tin nhắn của channel đang xem (và tin nhắn riêng)
+ */
+function markVisibleAsRead() {
+  if (document.visibilityState !== "visible") return;
+  for (const channel of ["", currentChannel]) {
+    (unreadByChannel[channel] || []).forEach((id) => queueAck("read", id));
+    delete unreadByChannel[channel];
+  }
+}
+
+/**
+ * Gắn id và giờ server vào phần tử tin nhắn; tin nhắn của mình có thêm dòng
+ * trạng thái receipt
+ */
+function applyEventMeta(el, msg) {
+  if (!el || msg.id === undefined) return;
+  el.dataset.eventId = msg.id;
+
+  const timeSpan = el.querySelector(".message-time");
+  if (timeSpan && msg.time) {
+    timeSpan.textContent = new Date(msg.time).toLocaleTimeString();
+    timeSpan.title = new Date(msg.time).toLocaleString();
+  }
+
+  if (msg.sender_id === clientId) {
+    const receipt = document.createElement("div");
+    receipt.className = "message-receipt";
+    el.querySelector(".message-bubble").appendChild(receipt);
+    if (receiptsById[msg.id]) renderReceipt(msg.id, receiptsById[msg.id]);
+  }
+}
+
+/**
+ * Cập nhật trạng thái tin nhắn của mình khi nhận receipt từ server
+ */
+function handleReceipt(msg) {
+  msg.ids.forEach((id) => {
+    const state = receiptsById[id] = receiptsById[id] || { delivered: new Set(), read: new Set() };
+    state[msg.status].add(msg.by.name);
+    if (msg.status === "read") state.delivered.add(msg.by.name);
+    renderReceipt(id, state);
+  });
+}
+
+function renderReceipt(id, state) {
+  const el = document.querySelector(`[data-event-id="${id}"] .message-receipt`);
+  if (!el) return;
+  if (state.read.size > 0) {
+    el.textContent = `✓✓ Read by ${Array.from(state.read).join(", ")}`;
+  } else if (state.delivered.size > 0) {
+    el.textContent = "✓ Delivered";
+  }
+}
+
+function resetReceipts() {
+  pendingAcks = { delivered: [], read: [] };
+  clearTimeout(ackTimer);
+  ackTimer = null;
+  unreadByChannel = {};
+}
+
+document.addEventListener("visibilitychange", markVisibleAsRead);
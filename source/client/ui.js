@@ -4,13 +4,13 @@
 
 /**
  * Cập nhật danh sách người dùng online
- * @param {Array} list - Danh sách tên người dùng online
+ * @param {Array} list - Danh sách người dùng online dạng {id, name}
  */
-function updateOnlineList(list) {
+function updateOnlineList(list, offline = []) {
   const onlineList = document.getElementById("online-list");
   const userCount = document.getElementById("user-count");
   
-  if (list.length === 0) {
+  if (list.length === 0 && offline.length === 0) {
     onlineList.innerHTML = `
       <div class="has-text-centered has-text-grey">
         <i class="fas fa-user-friends fa-2x" style="opacity: 0.3;"></i>
@@ -22,12 +22,13 @@ function updateOnlineList(list) {
   }
 
   onlineList.innerHTML = "";
-  list.forEach((userName) => {
+  list.forEach((user) => {
+    const userName = typeof user === 'string' ? user : user.name;
     const userDiv = document.createElement("div");
     userDiv.className = "online-user";
     
     const avatar = document.createElement("div");
-    avatar.className = "user-avatar";
+    avatar.className = `user-avatar presence-${user.presence || "online"}`;
     avatar.textContent = userName.charAt(0).toUpperCase();
     
     const userInfo = document.createElement("div");
@@ -35,15 +36,46 @@ function updateOnlineList(list) {
     
     const nameSpan = document.createElement("div");
     nameSpan.className = "user-name";
-    nameSpan.textContent = userName;
+    nameSpan.textContent = user.id === clientId ? `${userName} (you)` : userName;
     
     const statusSpan = document.createElement("div");
     statusSpan.className = "user-status";
-    statusSpan.textContent = "Online";
+    statusSpan.textContent = presenceLabel(user);
     
     userInfo.appendChild(nameSpan);
     userInfo.appendChild(statusSpan);
     
+    userDiv.appendChild(avatar);
+    userDiv.appendChild(userInfo);
+    if (user.id !== clientId) {
+      userDiv.title = `Send a private message to ${userName}`;
+      userDiv.onclick = () => startDirectMessage(userName);
+    }
+    onlineList.appendChild(userDiv);
+  });
+
+  // Thành viên đã rời channel, kèm thời điểm last seen
+  offline.forEach((user) => {
+    const userDiv = document.createElement("div");
+    userDiv.className = "online-user offline-user";
+
+    const avatar = document.createElement("div");
+    avatar.className = "user-avatar";
+    avatar.textContent = user.name.charAt(0).toUpperCase();
+
+    const userInfo = document.createElement("div");
+    userInfo.className = "user-info";
+
+    const nameSpan = document.createElement("div");
+    nameSpan.className = "user-name";
+    nameSpan.textContent = user.name;
+
+    const statusSpan = document.createElement("div");
+    statusSpan.className = "user-status";
+    statusSpan.textContent = lastSeenLabel(user.last_seen);
+
+    userInfo.appendChild(nameSpan);
+    userInfo.appendChild(statusSpan);
     userDiv.appendChild(avatar);
     userDiv.appendChild(userInfo);
     onlineList.appendChild(userDiv);
@@ -57,8 +89,11 @@ function updateOnlineList(list) {
  * Thêm một tin nhắn vào khung chat
  * @param {string} sender - Tên người gửi
  * @param {string} message - Nội dung tin nhắn
+ * @param {string} [channel] - Channel của tin nhắn, hiển thị nhãn nếu khác channel đang xem
+ * @param {string} [privateLabel] - Nhãn cho tin nhắn riêng, ví dụ "private to An"
+ * @returns {HTMLElement} Phần tử tin nhắn vừa thêm
  */
-function addMessageElement(sender, message) {
+function addMessageElement(sender, message, channel, privateLabel) {
   const messageDiv = document.createElement("div");
   messageDiv.className = "message";
   
@@ -90,6 +125,22 @@ function addMessageElement(sender, message) {
     messageBubble.appendChild(messageInfo);
   }
 
+  if (channel && channel !== currentChannel) {
+    const channelTag = document.createElement("span");
+    channelTag.className = "message-channel-tag";
+    channelTag.textContent = `#${channel}`;
+    messageBubble.appendChild(channelTag);
+  }
+
+  if (privateLabel) {
+    messageDiv.classList.add("private");
+    const privateTag = document.createElement("span");
+    privateTag.className = "message-private-tag";
+    privateTag.innerHTML = '<i class="fas fa-lock"></i> ';
+    privateTag.appendChild(document.createTextNode(privateLabel));
+    messageBubble.appendChild(privateTag);
+  }
+
   const messageText = document.createElement("div");
   messageText.className = "message-text";
   messageText.textContent = message;
@@ -100,6 +151,7 @@ function addMessageElement(sender, message) {
   const messages = document.getElementById("messages");
   messages.appendChild(messageDiv);
   messages.scrollTop = messages.scrollHeight;
+  return messageDiv;
 }
 
 /**
@@ -126,6 +178,8 @@ async function onJoin() {
     document.getElementById("message").disabled = false;
     document.getElementById("join-button").disabled = true;
     document.getElementById("disconnect-button").disabled = false;
+    document.getElementById("presence-state").disabled = false;
+    document.getElementById("presence-status").disabled = false;
 
     const welcomeTime = document.getElementById("welcome-time");
     if (welcomeTime) {
@@ -158,9 +212,17 @@ function updateUIOnDisconnect() {
   document.getElementById("message").disabled = true;
   document.getElementById("join-button").disabled = false;
   document.getElementById("disconnect-button").disabled = true;
+  document.getElementById("presence-state").disabled = true;
+  document.getElementById("presence-status").disabled = true;
   
-  updateOnlineList([]);
+  resetPresence();
+  resetChannels();
+  resetHistory();
+  resetReceipts();
   updateConnectionStatus('disconnected', 'Disconnected');
   transport = null;
+  datagramWriter = null;
+  clientId = null;
+  serverLimits = {};
   isConnecting = false;
 }
\ No newline at end of file
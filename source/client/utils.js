@@ -37,43 +37,15 @@ function showNotification(message, type = 'info') {
   }, 3000);
 }
 
-/**
- * Hiển thị chỉ báo đang nhập
- */
-function showTypingIndicator() {
-  const indicator = document.getElementById("typing-indicator");
-  if (indicator) {
-    indicator.style.display = "block";
-  }
-}
-
-/**
- * Ẩn chỉ báo đang nhập
- */
-function hideTypingIndicator() {
-  const indicator = document.getElementById("typing-indicator");
-  if (indicator) {
-    indicator.style.display = "none";
-  }
-}
-
 /**
  * Xử lý sự kiện khi người dùng đang nhập
  */
 function handleTyping() {
-  const now = Date.now();
-  if (now - lastTypingTime > 1000) {
-    showTypingIndicator();
-    lastTypingTime = now;
+  if (document.getElementById("message").value.trim() === "") {
+    stopTyping();
+    return;
   }
-  
-  if (typingTimeout) {
-    clearTimeout(typingTimeout);
-  }
-  
-  typingTimeout = setTimeout(() => {
-    hideTypingIndicator();
-  }, 2000);
+  notifyTyping();
 }
 
 /**
@@ -158,6 +130,3 @@ document.addEventListener("DOMContentLoaded", () => {
     welcomeTime.textContent = new Date().toLocaleTimeString();
   }
 });
-
-let typingTimeout = null;
-let lastTypingTime = 0;
\ No newline at end of file
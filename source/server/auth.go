@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Principal is the identity a session was authenticated as. It is attached
+// to every Client so handlers can make authorization decisions.
+type Principal struct {
+	Subject   string   // stable user identifier (token "sub" or username)
+	Name      string   // display name requested for the chat
+	Roles     []string // e.g. "admin"
+	Anonymous bool     // true when authentication is disabled
+
+	// ResumeToken lets an anonymous client reclaim the same identity (and
+	// its channel memberships) when it reconnects with ?resume=<token>.
+	ResumeToken string
+}
+
+// HasRole reports whether the principal was granted role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the principal has the "admin" role.
+func (p *Principal) IsAdmin() bool {
+	return p.HasRole("admin")
+}
+
+// errNoCredentials is returned by an Authenticator when the request does not
+// carry the kind of credentials it handles, so the next one can be tried.
+var errNoCredentials = errors.New("no credentials")
+
+// Authenticator verifies the credentials of a /chat request before the
+// WebTransport upgrade.
+//
+// Browsers cannot set headers on a WebTransport CONNECT request, so every
+// implementation also accepts its credentials as query parameters.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// NewAuthenticator builds the authenticator selected by cfg.AuthMode.
+func NewAuthenticator(cfg *Config) (Authenticator, error) {
+	var chain chainAuthenticator
+	for _, mode := range strings.Split(cfg.AuthMode, ",") {
+		switch strings.TrimSpace(mode) {
+		case "none":
+			return anonymousAuthenticator{}, nil
+		case "token":
+			chain = append(chain, &tokenAuthenticator{secret: []byte(cfg.AuthTokenSecret)})
+		case "users":
+			users, err := loadUsersFile(cfg.AuthUsersFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, users)
+		default:
+			return nil, fmt.Errorf("unknown auth mode %q", mode)
+		}
+	}
+	return chain, nil
+}
+
+// requestedName returns the display name asked for in the ?name= parameter.
+func requestedName(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get("name"))
+}
+
+// resumeTokenPattern matches the tokens issued by newResumeToken.
+var resumeTokenPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// anonymousAuthenticator accepts everyone and trusts the ?name= parameter.
+// Each anonymous identity is a random resume token, which is unguessable
+// and therefore safe to accept back from the client as-is.
+type anonymousAuthenticator struct{}
+
+func (anonymousAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name := requestedName(r)
+	if name == "" {
+		name = "Anonymous"
+	}
+	token := r.URL.Query().Get("resume")
+	if !resumeTokenPattern.MatchString(token) {
+		token = newResumeToken()
+	}
+	return &Principal{Subject: "anon:" + token, Name: name, Anonymous: true, ResumeToken: token}, nil
+}
+
+// newResumeToken returns 128 random bits as hex.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// chainAuthenticator tries each authenticator in turn and uses the first one
+// that finds credentials it understands.
+type chainAuthenticator []Authenticator
+
+func (c chainAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, errNoCredentials
+}
+
+// tokenAuthenticator verifies HS256-signed JWTs given as
+// "Authorization: Bearer <token>" or ?access_token=<token>.
+//
+// Recognised claims: sub (required), name, roles, exp and nbf.
+type tokenAuthenticator struct {
+	secret []byte
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return nil, errNoCredentials
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Subject
+	}
+	return &Principal{Subject: claims.Subject, Name: name, Roles: claims.Roles}, nil
+}
+
+// verify checks the signature and time claims of a compact JWT.
+func (a *tokenAuthenticator) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return &claims, nil
+}
+
+func decodeTokenSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// usersAuthenticator checks a username and password against a static users
+// file with bcrypt hashes. Credentials are read from HTTP Basic auth or the
+// ?user= and ?password= parameters.
+type usersAuthenticator struct {
+	users map[string]userEntry
+}
+
+type userEntry struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	DisplayName  string   `json:"display_name,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+}
+
+// loadUsersFile reads a JSON file of the form {"users": [userEntry, ...]}.
+func loadUsersFile(path string) (*usersAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read users file: %w", err)
+	}
+
+	var file struct {
+		Users []userEntry `json:"users"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", path, err)
+	}
+
+	a := &usersAuthenticator{users: make(map[string]userEntry, len(file.Users))}
+	for i, u := range file.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("users file %s: entry %d has no username", path, i)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("users file %s: user %q: invalid bcrypt hash", path, u.Username)
+		}
+		if _, dup := a.users[u.Username]; dup {
+			return nil, fmt.Errorf("users file %s: duplicate user %q", path, u.Username)
+		}
+		a.users[u.Username] = u
+	}
+	return a, nil
+}
+
+func (a *usersAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		q := r.URL.Query()
+		username, password = q.Get("user"), q.Get("password")
+		if username == "" {
+			return nil, errNoCredentials
+		}
+	}
+
+	u, found := a.users[username]
+	if !found {
+		// Compare against a dummy hash anyway so timing does not reveal valid usernames
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, errors.New("invalid username or password")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, errors.New("invalid username or password")
+	}
+
+	name := u.DisplayName
+	if name == "" {
+		name = u.Username
+	}
+	return &Principal{Subject: u.Username, Name: name, Roles: u.Roles}, nil
+}
+
+// dummyPasswordHash is a bcrypt hash of an unused password, used to equalize
+// the cost of failed logins for unknown users.
+var dummyPasswordHash = []byte("$2a$10$GfbUCKsOY0zSblLMYB6P6uC9nBzluwxJhV4tlLZGtXKv.f3E9P6RG")
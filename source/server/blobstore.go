@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// blobsDirName is the hidden directory under UploadDir holding the content
+// of shared files, stored once per distinct SHA-256 however many names and
+// versions refer to it.
+const blobsDirName = ".blobs"
+
+var errBlobNotFound = errors.New("content not stored")
+
+// BlobStore is a content-addressed store of file contents, keyed by their
+// hex SHA-256 and kept in a Storage. File names refer to blobs through
+// their version index; the store counts those references and deletes a
+// blob once nothing refers to it any more. A blob just composed is also
+// kept until the uploader has published it or given up.
+type BlobStore struct {
+	storage Storage
+
+	mutex   sync.Mutex
+	refs    map[string]int
+	pending map[string]int // reservations taken by Compose
+}
+
+// OpenBlobStore opens the blob store kept in storage. Reference counts
+// start at zero and are added back by whoever loads the references.
+func OpenBlobStore(storage Storage) *BlobStore {
+	return &BlobStore{
+		storage: storage,
+		refs:    make(map[string]int),
+		pending: make(map[string]int),
+	}
+}
+
+// blobKey spreads blobs over prefixes named after the first two hex digits
+// of their hash, so no single directory grows too large.
+func blobKey(hash string) string {
+	hash = strings.ToLower(hash)
+	return path.Join(blobsDirName, hash[:2], hash)
+}
+
+// Has reports whether content with the given hash and size is stored.
+func (b *BlobStore) Has(hash string, size int64) bool {
+	if !sha256Pattern.MatchString(hash) {
+		return false
+	}
+	obj, err := b.storage.Stat(blobKey(hash))
+	return err == nil && obj.Size == size
+}
+
+// Store moves the local file src into the store as the blob for hash,
+// which the caller has verified. If the content is already stored the file
+// is deleted instead. Store does not add a reference.
+func (b *BlobStore) Store(src, hash string) error {
+	if !sha256Pattern.MatchString(hash) {
+		return errors.New("invalid content hash")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := b.storage.Stat(blobKey(hash)); err == nil {
+		return os.Remove(src)
+	}
+	return b.storage.PutPart(blobKey(hash), src)
+}
+
+// Compose stores the concatenation of the objects parts as the blob for
+// hash, which the caller has verified, unless that content is already
+// stored. Compose does not add a reference, but on success the blob is
+// reserved and is not deleted until the caller calls Release, so that it
+// is still there when the caller refers to it.
+func (b *BlobStore) Compose(hash string, parts []string) error {
+	if !sha256Pattern.MatchString(hash) {
+		return errors.New("invalid content hash")
+	}
+	hash = strings.ToLower(hash)
+	b.mutex.Lock()
+	b.pending[hash]++
+	b.mutex.Unlock()
+
+	// Composing may take long, so it runs without the lock; the
+	// reservation keeps the blob from being deleted meanwhile
+	if _, err := b.storage.Stat(blobKey(hash)); err == nil {
+		return nil
+	}
+	if err := b.storage.Compose(blobKey(hash), parts); err != nil {
+		b.Release(hash)
+		return err
+	}
+	return nil
+}
+
+// Release drops the reservation Compose took on the blob for hash, and
+// deletes the blob unless something refers to it, such as content stored
+// for a file that could not be published.
+func (b *BlobStore) Release(hash string) {
+	hash = strings.ToLower(hash)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pending[hash] > 1 {
+		b.pending[hash]--
+		return
+	}
+	delete(b.pending, hash)
+	if b.refs[hash] > 0 {
+		return
+	}
+	if err := b.storage.Delete(blobKey(hash)); err != nil {
+		log.Printf("Failed to remove blob %s: %v", hash, err)
+	}
+}
+
+// Ref adds a reference to the blob for hash. It fails if the blob is not
+// stored.
+func (b *BlobStore) Ref(hash string) error {
+	if !sha256Pattern.MatchString(hash) {
+		return errBlobNotFound
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, err := b.storage.Stat(blobKey(hash)); err != nil {
+		return errBlobNotFound
+	}
+	b.refs[strings.ToLower(hash)]++
+	return nil
+}
+
+// Unref drops a reference to the blob for hash and deletes the blob when it
+// was the last one and the blob is not reserved.
+func (b *BlobStore) Unref(hash string) {
+	hash = strings.ToLower(hash)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.refs[hash] > 1 {
+		b.refs[hash]--
+		return
+	}
+	delete(b.refs, hash)
+	if b.pending[hash] > 0 {
+		return
+	}
+	if err := b.storage.Delete(blobKey(hash)); err != nil {
+		log.Printf("Failed to remove blob %s: %v", hash, err)
+	}
+}
+
+// Open opens length bytes of the blob for hash starting at offset; a
+// negative length reads to the end.
+func (b *BlobStore) Open(hash string, offset, length int64) (io.ReadCloser, error) {
+	if !sha256Pattern.MatchString(hash) {
+		return nil, errBlobNotFound
+	}
+	return b.storage.OpenRange(blobKey(hash), offset, length)
+}
+
+// Sweep deletes the blobs nothing refers to, such as content left behind
+// by a crash, and returns how many blobs are kept and how many were
+// removed. It must only run once every reference has been loaded.
+func (b *BlobStore) Sweep() (kept, removed int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	objects, err := b.storage.List(blobsDirName + "/")
+	if err != nil {
+		log.Printf("Error reading blob store: %v", err)
+		return 0, 0
+	}
+	for _, obj := range objects {
+		hash := path.Base(obj.Key)
+		if !sha256Pattern.MatchString(hash) {
+			continue // e.g. a blob still being composed
+		}
+		if b.refs[hash] > 0 || b.pending[hash] > 0 {
+			kept++
+			continue
+		}
+		if err := b.storage.Delete(obj.Key); err != nil {
+			log.Printf("Failed to remove blob %s: %v", hash, err)
+			continue
+		}
+		removed++
+	}
+	return kept, removed
+}
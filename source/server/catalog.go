@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// catalogKey is the sidecar index holding the version index of every
+// shared file, kept in storage next to the version indexes. Each change to a
+// version index is written to it as well, so at startup LoadFiles reads
+// this one object instead of every index, unless it is out of date. While
+// the server runs the catalog is kept in memory and the file list is built
+// from it.
+const catalogKey = ".catalog.json"
+
+// Limits on the metadata a client may attach to an upload.
+const (
+	maxDescriptionLen = 500 // characters
+	maxTags           = 10
+	maxTagLen         = 32 // characters
+)
+
+// File list pages served to "files" requests.
+const (
+	defaultFilePage = 50
+	maxFilePage     = 200
+
+	// maxFileOffset bounds the offset of a page, well above any file
+	// count, so that it always converts safely to an int.
+	maxFileOffset = 1 << 30
+)
+
+// sniffLen is how many leading bytes of a file are used to detect its MIME
+// type, as in http.DetectContentType.
+const sniffLen = 512
+
+// fileMeta describes a shared file in the catalog and in the file list:
+// its current version, who uploaded it and when, and how many versions are
+// kept.
+type fileMeta struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Version     int       `json:"version"`
+	Versions    int       `json:"versions"`
+	Uploader    string    `json:"uploader,omitempty"`
+	Time        time.Time `json:"time"`
+	MIME        string    `json:"mime,omitempty"`
+	SHA256      string    `json:"sha256"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// newFileMeta describes the file name, whose versions are given oldest
+// first.
+func newFileMeta(name string, versions []fileVersion) fileMeta {
+	current := versions[len(versions)-1]
+	return fileMeta{
+		Name:        name,
+		Size:        current.Size,
+		Version:     current.Version,
+		Versions:    len(versions),
+		Uploader:    current.Uploader,
+		Time:        current.Time.UTC(),
+		MIME:        current.MIME,
+		SHA256:      current.SHA256,
+		Description: current.Description,
+		Tags:        current.Tags,
+	}
+}
+
+// normalizeTags trims and lowercases tags and drops empty and repeated
+// ones. It fails if too many tags remain or one of them is too long.
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLen {
+			return nil, fmt.Errorf("tags must be at most %d characters", maxTagLen)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
+
+// sniffWriter keeps the first sniffLen bytes written to it.
+type sniffWriter struct {
+	buf []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(w.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// mimeType returns the MIME type detected from the bytes kept.
+func (w *sniffWriter) mimeType() string {
+	return http.DetectContentType(w.buf)
+}
+
+// sniffBlob returns the MIME type detected from the content stored for
+// hash.
+func (b *BlobStore) sniffBlob(hash string) (string, error) {
+	r, err := b.Open(hash, 0, sniffLen)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var w sniffWriter
+	if _, err := io.Copy(&w, r); err != nil {
+		return "", err
+	}
+	return w.mimeType(), nil
+}
+
+// setCatalogLocked records the version index of name in the in-memory
+// catalog; an index without versions removes the file. saveCatalogLocked
+// then writes the sidecar. The caller must hold m.publishMutex.
+func (m *MessageServer) setCatalogLocked(name string, idx versionIndex) {
+	if len(idx.Versions) == 0 {
+		delete(m.catalog, name)
+		return
+	}
+	m.catalog[name] = idx
+}
+
+// catalogListLocked returns the file list, sorted by name. The caller must
+// hold m.publishMutex.
+func (m *MessageServer) catalogListLocked() []fileMeta {
+	files := make([]fileMeta, 0, len(m.catalog))
+	for name, idx := range m.catalog {
+		files = append(files, newFileMeta(name, idx.Versions))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// saveCatalogLocked writes the catalog to the sidecar. A failure is only
+// logged: the in-memory catalog stays correct, and a sidecar older than a
+// version index is not used at the next start. The caller must hold
+// m.publishMutex.
+func (m *MessageServer) saveCatalogLocked() {
+	data, err := json.Marshal(m.catalog)
+	if err == nil {
+		err = putBytes(m.storage, m.uploads.dir, catalogKey, data)
+	}
+	if err != nil {
+		log.Printf("[WARN] Failed to write file catalog: %v", err)
+	}
+}
+
+// loadCatalog returns the version index of every file as recorded in the
+// sidecar, given the version indexes in storage keyed by file name. It
+// returns nil, so that the indexes are read instead, if the sidecar is
+// missing or unreadable, or out of date: it lists other files than indexes,
+// an index was modified after it (e.g. by a server that stopped before
+// updating the sidecar), or an index differs in size from the copy it
+// records. The size check covers storage whose modification times are too
+// coarse to order the two writes.
+func (m *MessageServer) loadCatalog(indexes map[string]StorageObject) map[string]versionIndex {
+	obj, err := m.storage.Stat(catalogKey)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[WARN] Cannot read file catalog: %v", err)
+		}
+		return nil
+	}
+	for name, index := range indexes {
+		if index.ModTime.After(obj.ModTime) {
+			log.Printf("File catalog is older than the version index of %s, rebuilding it", name)
+			return nil
+		}
+	}
+	data, err := readObject(m.storage, catalogKey)
+	if err != nil {
+		log.Printf("[WARN] Cannot read file catalog: %v", err)
+		return nil
+	}
+	var catalog map[string]versionIndex
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		log.Printf("[WARN] Invalid file catalog, rebuilding it: %v", err)
+		return nil
+	}
+	if len(catalog) != len(indexes) {
+		log.Printf("File catalog lists %d files instead of %d, rebuilding it", len(catalog), len(indexes))
+		return nil
+	}
+	for name, index := range indexes {
+		if len(catalog[name].Versions) == 0 {
+			log.Printf("File catalog does not list %s, rebuilding it", name)
+			return nil
+		}
+		if data, err := encodeIndex(catalog[name]); err != nil || int64(len(data)) != index.Size {
+			log.Printf("File catalog differs from the version index of %s, rebuilding it", name)
+			return nil
+		}
+	}
+	return catalog
+}
+
+// FileQuery selects a page of the file list. Query matches the name,
+// description and tags, MIME a type ("image/png") or type prefix
+// ("image/"), Tag one tag and Uploader the uploader's display name; empty
+// fields match every file. Sort is "name", "size", "time" or "type".
+type FileQuery struct {
+	Query    string
+	MIME     string
+	Tag      string
+	Uploader string
+	Sort     string
+	Desc     bool
+	Offset   int
+	Limit    int
+}
+
+// fileSorts orders files for each sort key of FileQuery.
+var fileSorts = map[string]func(a, b fileMeta) bool{
+	"name": func(a, b fileMeta) bool { return a.Name < b.Name },
+	"size": func(a, b fileMeta) bool { return a.Size < b.Size },
+	"time": func(a, b fileMeta) bool { return a.Time.Before(b.Time) },
+	"type": func(a, b fileMeta) bool { return a.MIME < b.MIME },
+}
+
+// matches reports whether f is selected by the filters of q.
+func (q FileQuery) matches(f fileMeta) bool {
+	if q.Query != "" {
+		text := strings.ToLower(f.Name + "\n" + f.Description + "\n" + strings.Join(f.Tags, "\n"))
+		if !strings.Contains(text, strings.ToLower(q.Query)) {
+			return false
+		}
+	}
+	if q.MIME != "" {
+		mime, _, _ := strings.Cut(f.MIME, ";")
+		if !strings.HasPrefix(mime, strings.ToLower(q.MIME)) {
+			return false
+		}
+	}
+	if q.Tag != "" {
+		found := false
+		for _, tag := range f.Tags {
+			found = found || tag == strings.ToLower(q.Tag)
+		}
+		if !found {
+			return false
+		}
+	}
+	return q.Uploader == "" || strings.EqualFold(f.Uploader, q.Uploader)
+}
+
+// QueryFiles returns the page of files selected by q and how many files
+// match in total. Files that sort equally stay in name order.
+func (m *MessageServer) QueryFiles(q FileQuery) ([]fileMeta, int) {
+	m.publishMutex.Lock()
+	files := m.catalogListLocked()
+	m.publishMutex.Unlock()
+
+	matched := files[:0]
+	for _, f := range files {
+		if q.matches(f) {
+			matched = append(matched, f)
+		}
+	}
+	less := fileSorts[q.Sort]
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.Desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	total := len(matched)
+	if q.Offset < 0 || q.Limit <= 0 || q.Offset >= total {
+		return []fileMeta{}, total
+	}
+	end := total
+	if q.Limit < total-q.Offset {
+		end = q.Offset + q.Limit
+	}
+	return matched[q.Offset:end], total
+}
+
+// handleFilesRequest serves {"type":"files","q","mime","tag","uploader",
+// "sort","order","offset","limit"} with a page of the file list:
+// {"type":"files","files":[...],"total",...}, repeating the request so the
+// client can tell which query the page answers.
+func handleFilesRequest(server *MessageServer, client *Client, msg map[string]interface{}) {
+	q := FileQuery{Sort: "name", Limit: defaultFilePage}
+	q.Query, _ = msg["q"].(string)
+	q.MIME, _ = msg["mime"].(string)
+	q.Tag, _ = msg["tag"].(string)
+	q.Uploader, _ = msg["uploader"].(string)
+	if s, ok := msg["sort"].(string); ok && s != "" {
+		q.Sort = s
+	}
+	if _, ok := fileSorts[q.Sort]; !ok {
+		server.sendError(client, "files", fmt.Errorf(`"sort" must be "name", "size", "time" or "type", got %q`, q.Sort))
+		return
+	}
+	order, _ := msg["order"].(string)
+	switch order {
+	case "", "asc":
+		order = "asc"
+	case "desc":
+		q.Desc = true
+	default:
+		server.sendError(client, "files", fmt.Errorf(`"order" must be "asc" or "desc", got %q`, order))
+		return
+	}
+	// Clamp while still a float64: converting a huge value to int overflows
+	if n, ok := msg["offset"].(float64); ok && n > 0 {
+		if n > maxFileOffset {
+			n = maxFileOffset
+		}
+		q.Offset = int(n)
+	}
+	if n, ok := msg["limit"].(float64); ok && n > 0 {
+		if n > maxFilePage {
+			n = maxFilePage
+		}
+		q.Limit = int(n)
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Limit <= 0 || q.Limit > maxFilePage {
+		q.Limit = maxFilePage
+	}
+
+	files, total := server.QueryFiles(q)
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":     "files",
+		"files":    files,
+		"total":    total,
+		"q":        q.Query,
+		"mime":     q.MIME,
+		"tag":      q.Tag,
+		"uploader": q.Uploader,
+		"sort":     q.Sort,
+		"order":    order,
+		"offset":   q.Offset,
+		"limit":    q.Limit,
+	})
+	server.SendMessage(client, data)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultChannel is created at startup and joined by every new identity.
+const defaultChannel = "general"
+
+// membershipRetention is how long the channel memberships of an identity
+// are remembered after its last session disconnects.
+const membershipRetention = 24 * time.Hour
+
+// channelNamePattern restricts channel names to short lowercase slugs.
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Channel is a named room that scopes chat, file notifications, drawings
+// and the online list.
+type Channel struct {
+	Name      string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// membership records the channels an identity (Principal.Subject) belongs
+// to, so that it survives reconnects.
+type membership struct {
+	channels map[string]bool
+	lastSeen time.Time
+	name     string // display name of the last session that left
+}
+
+// normalizeChannelName lowercases a channel name and validates it.
+func normalizeChannelName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "#")))
+	if !channelNamePattern.MatchString(name) {
+		return "", errors.New("invalid channel name: use 1-32 lowercase letters, digits, '-' or '_'")
+	}
+	return name, nil
+}
+
+// restoreMembershipLocked attaches the stored memberships of c's identity,
+// or joins a new identity to the default channel. The caller must hold m.mutex.
+func (m *MessageServer) restoreMembershipLocked(c *Client) {
+	m.pruneMembershipsLocked()
+
+	ms, ok := m.memberships[c.Principal.Subject]
+	if !ok {
+		ms = &membership{channels: map[string]bool{defaultChannel: true}}
+		m.memberships[c.Principal.Subject] = ms
+	}
+	// Drop channels that no longer exist
+	for name := range ms.channels {
+		if _, exists := m.channels[name]; !exists {
+			delete(ms.channels, name)
+		}
+	}
+	ms.lastSeen = time.Now()
+}
+
+// pruneMembershipsLocked forgets identities that have been gone longer than
+// membershipRetention. The caller must hold m.mutex.
+func (m *MessageServer) pruneMembershipsLocked() {
+	online := make(map[string]bool, len(m.listeners))
+	for _, c := range m.listeners {
+		online[c.Principal.Subject] = true
+	}
+	cutoff := time.Now().Add(-membershipRetention)
+	for subject, ms := range m.memberships {
+		if !online[subject] && ms.lastSeen.Before(cutoff) {
+			delete(m.memberships, subject)
+		}
+	}
+}
+
+// ClientChannels returns the sorted channel names c belongs to.
+func (m *MessageServer) ClientChannels(c *Client) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.clientChannelsLocked(c)
+}
+
+func (m *MessageServer) clientChannelsLocked(c *Client) []string {
+	ms, ok := m.memberships[c.Principal.Subject]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(ms.channels))
+	for name := range ms.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsMember reports whether c belongs to channel.
+func (m *MessageServer) IsMember(c *Client, channel string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.isMemberLocked(c, channel)
+}
+
+func (m *MessageServer) isMemberLocked(c *Client, channel string) bool {
+	ms, ok := m.memberships[c.Principal.Subject]
+	return ok && ms.channels[channel]
+}
+
+// CreateChannel creates a channel and makes c its first member.
+func (m *MessageServer) CreateChannel(c *Client, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.channels[name]; exists {
+		return errors.New("channel already exists")
+	}
+	m.channels[name] = &Channel{Name: name, CreatedBy: c.Name, CreatedAt: time.Now()}
+	m.memberships[c.Principal.Subject].channels[name] = true
+	log.Printf("[%s] Created channel #%s", c.Name, name)
+	return nil
+}
+
+// JoinChannel adds c to an existing channel.
+func (m *MessageServer) JoinChannel(c *Client, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.channels[name]; !exists {
+		return errors.New("channel does not exist")
+	}
+	ms := m.memberships[c.Principal.Subject]
+	if ms.channels[name] {
+		return errors.New("already a member of this channel")
+	}
+	ms.channels[name] = true
+	log.Printf("[%s] Joined channel #%s", c.Name, name)
+	return nil
+}
+
+// LeaveChannel removes c from a channel.
+func (m *MessageServer) LeaveChannel(c *Client, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ms := m.memberships[c.Principal.Subject]
+	if !ms.channels[name] {
+		return errors.New("not a member of this channel")
+	}
+	delete(ms.channels, name)
+	log.Printf("[%s] Left channel #%s", c.Name, name)
+	return nil
+}
+
+// ChannelList describes every channel from the point of view of c.
+func (m *MessageServer) ChannelList(c *Client) []map[string]interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := make([]map[string]interface{}, 0, len(m.channels))
+	for name, ch := range m.channels {
+		list = append(list, map[string]interface{}{
+			"name":       name,
+			"created_by": ch.CreatedBy,
+			"online":     len(m.channelMembersLocked(name)),
+			"joined":     m.isMemberLocked(c, name),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+	return list
+}
+
+// channelMembersLocked returns the connected clients that belong to channel.
+// The caller must hold m.mutex.
+func (m *MessageServer) channelMembersLocked(channel string) []*Client {
+	var members []*Client
+	for _, c := range m.listeners {
+		if m.isMemberLocked(c, channel) {
+			members = append(members, c)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// BroadcastToChannel records event in the channel history and sends it to
+// every connected member of channel. sender is nil for server notices;
+// otherwise it receives the delivery and read receipts of the event. The
+// encoded event, carrying its id and time, is returned.
+func (m *MessageServer) BroadcastToChannel(channel string, sender *Client, event map[string]interface{}) []byte {
+	m.mutex.Lock()
+	message := m.stampLocked(channel, event)
+	if message == nil {
+		m.mutex.Unlock()
+		return nil
+	}
+	if sender != nil {
+		m.receipts.track(event, sender.Principal.Subject, channel, nil)
+	}
+
+	// Drawings are bulky; they go to the bulk lane so they never delay chat
+	bulk := event["type"] == "drawing"
+	m.deliverAndUnlock(m.channelMembersLocked(channel), outboundMessage{data: message, bulk: bulk})
+	return message
+}
+
+// sendChannelList sends the channel list and c's memberships to c.
+func (m *MessageServer) sendChannelList(c *Client) {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":     "channels",
+		"channels": m.ChannelList(c),
+		"joined":   m.ClientChannels(c),
+	})
+	m.sendState(c, "channels", msg)
+}
+
+// sendError reports a failed request back to the client that made it.
+func (m *MessageServer) sendError(c *Client, request string, err error) {
+	msg, _ := json.Marshal(map[string]string{"type": "error", "request": request, "error": err.Error()})
+	m.SendMessage(c, msg)
+}
+
+// handleChannelCommand processes channel_create, channel_join,
+// channel_leave and channel_list requests sent on a chat stream.
+func handleChannelCommand(server *MessageServer, client *Client, msgType string, msg map[string]interface{}) {
+	if msgType == "channel_list" {
+		server.sendChannelList(client)
+		return
+	}
+
+	raw, _ := msg["channel"].(string)
+	name, err := normalizeChannelName(raw)
+	if err != nil {
+		server.sendError(client, msgType, err)
+		return
+	}
+
+	var notice string
+	switch msgType {
+	case "channel_create":
+		err = server.CreateChannel(client, name)
+		notice = client.Name + " created #" + name + "."
+	case "channel_join":
+		err = server.JoinChannel(client, name)
+		notice = client.Name + " joined #" + name + "."
+	case "channel_leave":
+		err = server.LeaveChannel(client, name)
+		notice = client.Name + " left #" + name + "."
+	}
+	if err != nil {
+		server.sendError(client, msgType, err)
+		return
+	}
+
+	noticeMsg := server.BroadcastToChannel(name, nil, map[string]interface{}{"type": "system", "message": notice})
+	if msgType == "channel_leave" {
+		// The leaver no longer receives channel traffic, so tell them directly
+		server.SendMessage(client, noticeMsg)
+	}
+
+	server.sendChannelList(client)
+	if msgType != "channel_leave" {
+		server.sendBackfill(client, name)
+	}
+	server.BroadcastOnlineList()
+}
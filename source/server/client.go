@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/quic-go/webtransport-go"
 )
 
@@ -8,9 +10,33 @@ import (
  * Cấu trúc đại diện cho một client kết nối
  */
 type Client struct {
-	Name    string                
-	Session *webtransport.Session 
-	Ch      chan []byte           
+	ID        int        // session ID, unique for the lifetime of the process
+	Name      string     // display name, unique among connected clients
+	Principal *Principal // authenticated identity of the session
+	Session   *webtransport.Session
+
+	// queue holds the events waiting to be written to SendStream. It is
+	// created by MessageServer.AddClient.
+	queue *outboundQueue
+
+	// Protocol and Features were negotiated in the hello/welcome exchange.
+	Protocol int
+	Features map[string]bool
+
+	// Presence and StatusText are guarded by MessageServer.mutex.
+	Presence   string
+	StatusText string
 
 	SendStream *webtransport.SendStream
+
+	// closing is closed to ask the send loop to flush queue and stop;
+	// flushed is closed by the send loop once it has done so.
+	closing   chan struct{}
+	flushed   chan struct{}
+	closeOnce sync.Once
+}
+
+// requestFlush asks the send loop to write out everything still queued.
+func (c *Client) requestFlush() {
+	c.closeOnce.Do(func() { close(c.closing) })
 }
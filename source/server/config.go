@@ -1,19 +1,793 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Default values used when neither the config file, the environment nor
+// the command line override a setting.
 const (
-	CHUNK_SIZE = 16 << 20 // 16MB
+	defaultListenAddr        = ":4433"
+	defaultCertFile          = "26.135.88.251.pem"
+	defaultKeyFile           = "26.135.88.251-key.pem"
+	defaultUploadDir         = "uploads"
+	defaultNumStreams        = 8
+	defaultChunkSize         = 16 << 20  // 16MB
+	defaultMaxFileSize       = 100 << 20 // 100MB, matches the client-side limit
+	defaultMaxDrawingSize    = 10 << 20  // 10MB
+	defaultMaxHeaderSize     = 16 << 10  // 16KB
+	defaultClientChannelSize = 256
+	defaultDevCertAddr       = "localhost:4434"
+	defaultShutdownGrace     = 30 * time.Second
+	defaultAuthMode          = "none"
+	defaultHistoryFile       = "history.log"
+	defaultHistoryBacklog    = 50
+	defaultOutboundPolicy    = policyBlock
+	defaultOutboundTimeout   = time.Second
+	defaultUploadTTL         = 24 * time.Hour
+	defaultUploadConflict    = conflictVersion
+	defaultMaxVersions       = 10
+	defaultFileEditPolicy    = editOwner
+	defaultStorage           = storageLocal
+	defaultS3Region          = "us-east-1"
 
-	NUM_STREAMS = 8
+	// minTokenSecretLen is the shortest HMAC secret accepted for token auth.
+	minTokenSecretLen = 32
+
+	// envPrefix is prepended to every environment variable the server reads.
+	envPrefix = "WT_"
 )
 
-// during file transfers. Each buffer is CHUNK_SIZE.
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, CHUNK_SIZE)
-		return &buf
+// ByteSize is a size in bytes that can be written as a plain number or with
+// a unit suffix such as "512KB", "16MB" or "1GiB" (units are powers of 1024).
+type ByteSize int64
+
+// String formats the size using the largest unit that divides it exactly.
+func (b ByteSize) String() string {
+	units := []struct {
+		suffix string
+		size   ByteSize
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}}
+	for _, u := range units {
+		if b >= u.size && b%u.size == 0 {
+			return fmt.Sprintf("%d%s", b/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// UnmarshalJSON accepts either a JSON number or a string with a unit suffix.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("size must be a number or a string like \"16MB\"")
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// parseByteSize parses strings such as "1048576", "512KB", "16MB" or "1GiB".
+func parseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			multiplier = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" or
+// "2m" in the config file.
+type Duration time.Duration
+
+// String formats the duration like time.Duration.
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// UnmarshalJSON accepts a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var secs float64
+		if err := json.Unmarshal(data, &secs); err != nil {
+			return fmt.Errorf("duration must be a string like \"30s\" or a number of seconds")
+		}
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// StringList is a list of strings written as a JSON array, or as a
+// comma-separated string in flags and environment variables.
+type StringList []string
+
+// String joins the list with commas.
+func (l StringList) String() string { return strings.Join(l, ",") }
+
+// UnmarshalJSON accepts a JSON array or a comma-separated string.
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var items []string
+	if err := json.Unmarshal(data, &items); err != nil {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("expected an array of strings or a comma-separated string")
+		}
+		items = splitList(s)
+	}
+	*l = items
+	return nil
+}
+
+// splitList splits a comma-separated string, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Config holds every tunable setting of the server.
+//
+// Values are resolved with the following precedence (highest first):
+// command-line flags, WT_* environment variables, the JSON config file
+// given by -config / WT_CONFIG, and finally the built-in defaults.
+type Config struct {
+	ListenAddr        string   `json:"listen_addr"`
+	CertFile          string   `json:"cert_file"`
+	KeyFile           string   `json:"key_file"`
+	UploadDir         string   `json:"upload_dir"`
+	NumStreams        int      `json:"num_streams"`
+	ChunkSize         ByteSize `json:"chunk_size"`
+	MaxFileSize       ByteSize `json:"max_file_size"`
+	MaxDrawingSize    ByteSize `json:"max_drawing_size"`
+	MaxHeaderSize     ByteSize `json:"max_header_size"`
+	ClientChannelSize int      `json:"client_channel_size"`
+
+	// DevTLS replaces CertFile/KeyFile with an in-memory self-signed
+	// certificate whose hash is served on DevCertAddr for pinning.
+	DevTLS      bool   `json:"dev_tls"`
+	DevCertAddr string `json:"dev_cert_addr"`
+
+	// ShutdownGrace is how long in-flight transfers may run after a
+	// shutdown signal before sessions are closed.
+	ShutdownGrace Duration `json:"shutdown_grace"`
+
+	// AuthMode is "none" or a comma-separated list of "token" and "users",
+	// tried in order.
+	AuthMode        string `json:"auth_mode"`
+	AuthTokenSecret string `json:"auth_token_secret"`
+	AuthUsersFile   string `json:"auth_users_file"`
+
+	// AllowedOrigins lists the web origins that may open a session. When it
+	// is empty only same-origin requests are accepted, unless AllowAnyOrigin
+	// is set for development.
+	AllowedOrigins StringList `json:"allowed_origins"`
+	AllowAnyOrigin bool       `json:"allow_any_origin"`
+
+	// HistoryFile is the append-only log of channel events. The last
+	// HistoryBacklog events of each channel are replayed on join.
+	HistoryFile    string `json:"history_file"`
+	HistoryBacklog int    `json:"history_backlog"`
+
+	// OutboundPolicy decides what happens when a client's outbound queue
+	// (ClientChannelSize messages) is full: "block" for up to
+	// OutboundTimeout, "drop-oldest", "coalesce" or "disconnect".
+	OutboundPolicy  string   `json:"outbound_policy"`
+	OutboundTimeout Duration `json:"outbound_timeout"`
+
+	// UploadTTL is how long an unfinished upload is kept, for resuming,
+	// after its last activity.
+	UploadTTL Duration `json:"upload_ttl"`
+
+	// UploadConflict decides what happens when an upload is merged under a
+	// name that already exists: "reject", "rename" or "version".
+	UploadConflict string `json:"upload_conflict"`
+
+	// MaxVersions is how many versions of a file are kept, the current one
+	// included; 0 keeps them all. Older versions are also removed once they
+	// are older than VersionMaxAge, unless it is 0.
+	MaxVersions   int      `json:"max_versions"`
+	VersionMaxAge Duration `json:"version_max_age"`
+
+	// FileEditPolicy decides who may publish new versions of, delete or
+	// rename a shared file: "owner" (whoever first published it, or an
+	// admin), "admin" or "anyone".
+	FileEditPolicy string `json:"file_edit_policy"`
+
+	// Storage is where shared files and finished upload parts are kept:
+	// "local" under UploadDir, or "s3" in the bucket S3Bucket of an
+	// S3-compatible object store at S3Endpoint. Upload sessions and parts
+	// being received always stay under UploadDir.
+	Storage     string `json:"storage"`
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3Prefix    string `json:"s3_prefix"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+	S3PathStyle bool   `json:"s3_path_style"`
+}
+
+// DefaultConfig returns a Config populated with the built-in defaults.
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:        defaultListenAddr,
+		CertFile:          defaultCertFile,
+		KeyFile:           defaultKeyFile,
+		UploadDir:         defaultUploadDir,
+		NumStreams:        defaultNumStreams,
+		ChunkSize:         defaultChunkSize,
+		MaxFileSize:       defaultMaxFileSize,
+		MaxDrawingSize:    defaultMaxDrawingSize,
+		MaxHeaderSize:     defaultMaxHeaderSize,
+		ClientChannelSize: defaultClientChannelSize,
+		DevCertAddr:       defaultDevCertAddr,
+		ShutdownGrace:     Duration(defaultShutdownGrace),
+		AuthMode:          defaultAuthMode,
+		HistoryFile:       defaultHistoryFile,
+		HistoryBacklog:    defaultHistoryBacklog,
+		OutboundPolicy:    defaultOutboundPolicy,
+		OutboundTimeout:   Duration(defaultOutboundTimeout),
+		UploadTTL:         Duration(defaultUploadTTL),
+		UploadConflict:    defaultUploadConflict,
+		MaxVersions:       defaultMaxVersions,
+		FileEditPolicy:    defaultFileEditPolicy,
+		Storage:           defaultStorage,
+		S3Region:          defaultS3Region,
+		S3PathStyle:       true,
+	}
+}
+
+// configOption describes a setting that can be given as a flag or an
+// environment variable. The environment variable name is derived from the
+// flag name: "max-file-size" becomes WT_MAX_FILE_SIZE.
+type configOption struct {
+	name   string
+	usage  string
+	isBool bool
+	get    func(c *Config) string
+	set    func(c *Config, v string) error
+}
+
+var configOptions = []configOption{
+	{
+		name:  "addr",
+		usage: "UDP address to listen on (host:port)",
+		get:   func(c *Config) string { return c.ListenAddr },
+		set:   func(c *Config, v string) error { c.ListenAddr = v; return nil },
+	},
+	{
+		name:  "cert",
+		usage: "path to the TLS certificate (PEM)",
+		get:   func(c *Config) string { return c.CertFile },
+		set:   func(c *Config, v string) error { c.CertFile = v; return nil },
+	},
+	{
+		name:  "key",
+		usage: "path to the TLS private key (PEM)",
+		get:   func(c *Config) string { return c.KeyFile },
+		set:   func(c *Config, v string) error { c.KeyFile = v; return nil },
+	},
+	{
+		name:  "upload-dir",
+		usage: "directory where uploaded files are stored",
+		get:   func(c *Config) string { return c.UploadDir },
+		set:   func(c *Config, v string) error { c.UploadDir = v; return nil },
+	},
+	{
+		name:  "num-streams",
+		usage: "number of parallel streams per file transfer",
+		get:   func(c *Config) string { return strconv.Itoa(c.NumStreams) },
+		set:   intSetter(func(c *Config) *int { return &c.NumStreams }),
+	},
+	{
+		name:  "chunk-size",
+		usage: "size of the copy buffers used for file transfers",
+		get:   func(c *Config) string { return c.ChunkSize.String() },
+		set:   sizeSetter(func(c *Config) *ByteSize { return &c.ChunkSize }),
+	},
+	{
+		name:  "max-file-size",
+		usage: "largest file accepted for upload",
+		get:   func(c *Config) string { return c.MaxFileSize.String() },
+		set:   sizeSetter(func(c *Config) *ByteSize { return &c.MaxFileSize }),
+	},
+	{
+		name:  "max-drawing-size",
+		usage: "largest drawing image accepted",
+		get:   func(c *Config) string { return c.MaxDrawingSize.String() },
+		set:   sizeSetter(func(c *Config) *ByteSize { return &c.MaxDrawingSize }),
+	},
+	{
+		name:  "max-header-size",
+		usage: "largest JSON header accepted on file and drawing streams",
+		get:   func(c *Config) string { return c.MaxHeaderSize.String() },
+		set:   sizeSetter(func(c *Config) *ByteSize { return &c.MaxHeaderSize }),
+	},
+	{
+		name:  "client-channel-size",
+		usage: "number of outgoing messages buffered per client",
+		get:   func(c *Config) string { return strconv.Itoa(c.ClientChannelSize) },
+		set:   intSetter(func(c *Config) *int { return &c.ClientChannelSize }),
+	},
+	{
+		name:   "dev-tls",
+		usage:  "generate a short-lived self-signed certificate instead of loading -cert/-key",
+		isBool: true,
+		get:    func(c *Config) string { return strconv.FormatBool(c.DevTLS) },
+		set:    boolSetter(func(c *Config) *bool { return &c.DevTLS }),
+	},
+	{
+		name:  "dev-cert-addr",
+		usage: "TCP address of the HTTP endpoint serving the dev certificate hash",
+		get:   func(c *Config) string { return c.DevCertAddr },
+		set:   func(c *Config, v string) error { c.DevCertAddr = v; return nil },
+	},
+	{
+		name:  "shutdown-grace",
+		usage: "time allowed for in-flight transfers to finish on shutdown",
+		get:   func(c *Config) string { return c.ShutdownGrace.String() },
+		set:   durationSetter(func(c *Config) *Duration { return &c.ShutdownGrace }),
+	},
+	{
+		name:  "auth-mode",
+		usage: `authentication for /chat: "none", or a list of "token" and "users"`,
+		get:   func(c *Config) string { return c.AuthMode },
+		set:   func(c *Config, v string) error { c.AuthMode = v; return nil },
+	},
+	{
+		name:  "auth-token-secret",
+		usage: "HMAC secret used to verify HS256 bearer tokens",
+		get:   func(c *Config) string { return c.AuthTokenSecret },
+		set:   func(c *Config, v string) error { c.AuthTokenSecret = v; return nil },
+	},
+	{
+		name:  "auth-users-file",
+		usage: "JSON file of users with bcrypt password hashes",
+		get:   func(c *Config) string { return c.AuthUsersFile },
+		set:   func(c *Config, v string) error { c.AuthUsersFile = v; return nil },
+	},
+	{
+		name:  "allowed-origins",
+		usage: `comma-separated origins allowed to connect, e.g. "https://chat.example.com,https://*.example.com"`,
+		get:   func(c *Config) string { return c.AllowedOrigins.String() },
+		set:   func(c *Config, v string) error { c.AllowedOrigins = splitList(v); return nil },
+	},
+	{
+		name:   "allow-any-origin",
+		usage:  "accept WebTransport sessions from any origin (development only)",
+		isBool: true,
+		get:    func(c *Config) string { return strconv.FormatBool(c.AllowAnyOrigin) },
+		set:    boolSetter(func(c *Config) *bool { return &c.AllowAnyOrigin }),
+	},
+	{
+		name:  "history-file",
+		usage: "append-only log file where chat, system, file and drawing events are stored",
+		get:   func(c *Config) string { return c.HistoryFile },
+		set:   func(c *Config, v string) error { c.HistoryFile = v; return nil },
 	},
+	{
+		name:  "history-backlog",
+		usage: "number of recent events per channel sent to a client when it joins",
+		get:   func(c *Config) string { return strconv.Itoa(c.HistoryBacklog) },
+		set:   intSetter(func(c *Config) *int { return &c.HistoryBacklog }),
+	},
+	{
+		name:  "outbound-policy",
+		usage: `what to do when a client's outbound queue is full: "block", "drop-oldest", "coalesce" or "disconnect"`,
+		get:   func(c *Config) string { return c.OutboundPolicy },
+		set:   func(c *Config, v string) error { c.OutboundPolicy = v; return nil },
+	},
+	{
+		name:  "outbound-timeout",
+		usage: `how long the "block" policy waits for a slow client before dropping a message`,
+		get:   func(c *Config) string { return c.OutboundTimeout.String() },
+		set:   durationSetter(func(c *Config) *Duration { return &c.OutboundTimeout }),
+	},
+	{
+		name:  "upload-ttl",
+		usage: "how long an unfinished upload is kept for resuming after its last activity",
+		get:   func(c *Config) string { return c.UploadTTL.String() },
+		set:   durationSetter(func(c *Config) *Duration { return &c.UploadTTL }),
+	},
+	{
+		name:  "upload-conflict",
+		usage: `what to do when an upload's name is taken: "reject", "rename" (e.g. "report (1).pdf") or "version"`,
+		get:   func(c *Config) string { return c.UploadConflict },
+		set:   func(c *Config, v string) error { c.UploadConflict = v; return nil },
+	},
+	{
+		name:  "max-versions",
+		usage: "how many versions of a file to keep, the current one included (0 keeps all)",
+		get:   func(c *Config) string { return strconv.Itoa(c.MaxVersions) },
+		set:   intSetter(func(c *Config) *int { return &c.MaxVersions }),
+	},
+	{
+		name:  "version-max-age",
+		usage: "remove older versions of a file after this long (0 keeps them)",
+		get:   func(c *Config) string { return c.VersionMaxAge.String() },
+		set:   durationSetter(func(c *Config) *Duration { return &c.VersionMaxAge }),
+	},
+	{
+		name:  "file-edit-policy",
+		usage: `who may publish new versions of, delete or rename a file: "owner" (whoever first published it, or an admin), "admin" or "anyone"`,
+		get:   func(c *Config) string { return c.FileEditPolicy },
+		set:   func(c *Config, v string) error { c.FileEditPolicy = v; return nil },
+	},
+	{
+		name:  "storage",
+		usage: `where shared files are kept: "local" (the upload directory) or "s3"`,
+		get:   func(c *Config) string { return c.Storage },
+		set:   func(c *Config, v string) error { c.Storage = v; return nil },
+	},
+	{
+		name:  "s3-endpoint",
+		usage: `URL of the S3-compatible object store, e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"`,
+		get:   func(c *Config) string { return c.S3Endpoint },
+		set:   func(c *Config, v string) error { c.S3Endpoint = v; return nil },
+	},
+	{
+		name:  "s3-region",
+		usage: "region used to sign S3 requests",
+		get:   func(c *Config) string { return c.S3Region },
+		set:   func(c *Config, v string) error { c.S3Region = v; return nil },
+	},
+	{
+		name:  "s3-bucket",
+		usage: "bucket holding the shared files",
+		get:   func(c *Config) string { return c.S3Bucket },
+		set:   func(c *Config, v string) error { c.S3Bucket = v; return nil },
+	},
+	{
+		name:  "s3-prefix",
+		usage: `prefix of every object key, e.g. "chat/"`,
+		get:   func(c *Config) string { return c.S3Prefix },
+		set:   func(c *Config, v string) error { c.S3Prefix = v; return nil },
+	},
+	{
+		name:  "s3-access-key",
+		usage: "S3 access key ID",
+		get:   func(c *Config) string { return c.S3AccessKey },
+		set:   func(c *Config, v string) error { c.S3AccessKey = v; return nil },
+	},
+	{
+		name:  "s3-secret-key",
+		usage: "S3 secret access key",
+		get:   func(c *Config) string { return c.S3SecretKey },
+		set:   func(c *Config, v string) error { c.S3SecretKey = v; return nil },
+	},
+	{
+		name:   "s3-path-style",
+		usage:  "address the bucket as endpoint/bucket rather than bucket.endpoint (MinIO and most S3-compatible stores)",
+		isBool: true,
+		get:    func(c *Config) string { return strconv.FormatBool(c.S3PathStyle) },
+		set:    boolSetter(func(c *Config) *bool { return &c.S3PathStyle }),
+	},
+}
+
+// optionFlag is the flag.Value registered for every configOption. It only
+// records the raw string so that precedence can be applied after parsing.
+type optionFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *optionFlag) String() string     { return f.value }
+func (f *optionFlag) Set(v string) error { f.value = v; return nil }
+func (f *optionFlag) IsBoolFlag() bool   { return f.isBool }
+
+func boolSetter(field func(c *Config) *bool) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func sizeSetter(field func(c *Config) *ByteSize) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func durationSetter(field func(c *Config) *Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*field(c) = Duration(d)
+		return nil
+	}
+}
+
+// envName returns the environment variable that maps to a flag name.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig builds the server configuration from the command-line
+// arguments (without the program name), the environment and an optional
+// config file, then validates the result.
+func LoadConfig(args []string) (*Config, error) {
+	defaults := DefaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envName("config")), "path to a JSON config file (env "+envName("config")+")")
+	for _, opt := range configOptions {
+		usage := fmt.Sprintf("%s (env %s, default %q)", opt.usage, envName(opt.name), opt.get(defaults))
+		fs.Var(&optionFlag{isBool: opt.isBool}, opt.name, usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := defaults
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range configOptions {
+		if v, ok := os.LookupEnv(envName(opt.name)); ok {
+			if err := opt.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName(opt.name), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range configOptions {
+			if opt.name == f.Name && flagErr == nil {
+				if err := opt.set(cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("-%s: %w", opt.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings found in a JSON config file.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that every setting is usable and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen address %q: %w", c.ListenAddr, err))
+	} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		errs = append(errs, fmt.Errorf("listen address %q: invalid port", c.ListenAddr))
+	}
+
+	if c.DevTLS {
+		if _, _, err := net.SplitHostPort(c.DevCertAddr); err != nil {
+			errs = append(errs, fmt.Errorf("dev cert address %q: %w", c.DevCertAddr, err))
+		}
+	} else {
+		for _, file := range []struct{ what, path string }{{"TLS certificate", c.CertFile}, {"TLS key", c.KeyFile}} {
+			if file.path == "" {
+				errs = append(errs, fmt.Errorf("%s path is empty", file.what))
+			} else if _, err := os.Stat(file.path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", file.what, err))
+			}
+		}
+	}
+
+	if c.UploadDir == "" {
+		errs = append(errs, errors.New("upload directory is empty"))
+	}
+	if c.NumStreams < 1 || c.NumStreams > 64 {
+		errs = append(errs, fmt.Errorf("num streams must be between 1 and 64, got %d", c.NumStreams))
+	}
+	if c.ChunkSize < 4<<10 || c.ChunkSize > 1<<30 {
+		errs = append(errs, fmt.Errorf("chunk size must be between 4KB and 1GB, got %s", c.ChunkSize))
+	}
+	if c.MaxFileSize <= 0 {
+		errs = append(errs, fmt.Errorf("max file size must be positive, got %s", c.MaxFileSize))
+	}
+	if c.MaxDrawingSize <= 0 {
+		errs = append(errs, fmt.Errorf("max drawing size must be positive, got %s", c.MaxDrawingSize))
+	}
+	if c.MaxHeaderSize < 1<<10 || c.MaxHeaderSize > 1<<20 {
+		errs = append(errs, fmt.Errorf("max header size must be between 1KB and 1MB, got %s", c.MaxHeaderSize))
+	}
+	if c.ClientChannelSize < 1 || c.ClientChannelSize > 1<<16 {
+		errs = append(errs, fmt.Errorf("client channel size must be between 1 and 65536, got %d", c.ClientChannelSize))
+	}
+
+	if c.ShutdownGrace < 0 || time.Duration(c.ShutdownGrace) > 10*time.Minute {
+		errs = append(errs, fmt.Errorf("shutdown grace must be between 0 and 10m, got %s", c.ShutdownGrace))
+	}
+
+	modes := strings.Split(c.AuthMode, ",")
+	for _, mode := range modes {
+		switch strings.TrimSpace(mode) {
+		case "none":
+			if len(modes) > 1 {
+				errs = append(errs, errors.New(`auth mode "none" cannot be combined with other modes`))
+			}
+		case "token":
+			if len(c.AuthTokenSecret) < minTokenSecretLen {
+				errs = append(errs, fmt.Errorf("auth mode token requires a token secret of at least %d bytes", minTokenSecretLen))
+			}
+		case "users":
+			if c.AuthUsersFile == "" {
+				errs = append(errs, errors.New("auth mode users requires a users file"))
+			} else if _, err := os.Stat(c.AuthUsersFile); err != nil {
+				errs = append(errs, fmt.Errorf("users file: %w", err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown auth mode %q", mode))
+		}
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if _, err := parseOriginPattern(origin); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.HistoryFile == "" {
+		errs = append(errs, errors.New("history file path is empty"))
+	}
+	if c.HistoryBacklog < 0 || c.HistoryBacklog > maxHistoryPage {
+		errs = append(errs, fmt.Errorf("history backlog must be between 0 and %d, got %d", maxHistoryPage, c.HistoryBacklog))
+	}
+
+	validPolicy := false
+	for _, p := range outboundPolicies {
+		validPolicy = validPolicy || c.OutboundPolicy == p
+	}
+	if !validPolicy {
+		errs = append(errs, fmt.Errorf("outbound policy must be one of %s, got %q", strings.Join(outboundPolicies, ", "), c.OutboundPolicy))
+	}
+	if c.OutboundTimeout <= 0 || time.Duration(c.OutboundTimeout) > 30*time.Second {
+		errs = append(errs, fmt.Errorf("outbound timeout must be positive and at most 30s, got %s", c.OutboundTimeout))
+	}
+	if time.Duration(c.UploadTTL) < time.Minute || time.Duration(c.UploadTTL) > 30*24*time.Hour {
+		errs = append(errs, fmt.Errorf("upload TTL must be between 1m and 720h, got %s", c.UploadTTL))
+	}
+	validConflict := false
+	for _, p := range conflictPolicies {
+		validConflict = validConflict || c.UploadConflict == p
+	}
+	if !validConflict {
+		errs = append(errs, fmt.Errorf("upload conflict policy must be one of %s, got %q", strings.Join(conflictPolicies, ", "), c.UploadConflict))
+	}
+	if c.MaxVersions < 0 || c.MaxVersions > 1000 {
+		errs = append(errs, fmt.Errorf("max versions must be between 0 and 1000, got %d", c.MaxVersions))
+	}
+	if c.VersionMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("version max age must not be negative, got %s", c.VersionMaxAge))
+	}
+	validEdit := false
+	for _, p := range editPolicies {
+		validEdit = validEdit || c.FileEditPolicy == p
+	}
+	if !validEdit {
+		errs = append(errs, fmt.Errorf("file edit policy must be one of %s, got %q", strings.Join(editPolicies, ", "), c.FileEditPolicy))
+	}
+
+	switch c.Storage {
+	case storageLocal:
+	case storageS3:
+		if u, err := url.Parse(c.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("S3 endpoint must be an http or https URL, got %q", c.S3Endpoint))
+		}
+		if c.S3Bucket == "" {
+			errs = append(errs, errors.New("storage s3 requires a bucket"))
+		}
+		if c.S3Region == "" {
+			errs = append(errs, errors.New("storage s3 requires a region"))
+		}
+		if c.S3AccessKey == "" || c.S3SecretKey == "" {
+			errs = append(errs, errors.New("storage s3 requires an access key and a secret key"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage must be one of %s, got %q", strings.Join(storageBackends, ", "), c.Storage))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// newBufferPool returns a pool of reusable byte slices used as copy buffers
+// during file transfers. Each buffer is size bytes.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
 }
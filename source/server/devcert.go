@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// WebTransport's serverCertificateHashes only accepts certificates whose
+	// total validity period is at most 14 days.
+	devCertValidity = 10 * 24 * time.Hour
+
+	// devCertRenewBefore is how long before expiry the next certificate is promoted.
+	devCertRenewBefore = 2 * 24 * time.Hour
+
+	// devCertBackdate tolerates small clock differences between server and browser.
+	devCertBackdate = time.Hour
+)
+
+// devCertManager issues short-lived self-signed ECDSA certificates for local
+// development and rotates them before they expire.
+//
+// It always keeps the next certificate ready and publishes both hashes, so a
+// browser that pinned the hashes just before a rotation can still connect.
+type devCertManager struct {
+	hosts []string
+
+	mutex   sync.RWMutex
+	current *tls.Certificate
+	next    *tls.Certificate
+}
+
+// newDevCertManager generates the initial certificate pair for the given hosts.
+func newDevCertManager(hosts []string) (*devCertManager, error) {
+	m := &devCertManager{hosts: hosts}
+
+	current, err := generateDevCert(hosts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	next, err := generateDevCert(hosts, current.Leaf.NotAfter.Add(-devCertRenewBefore))
+	if err != nil {
+		return nil, err
+	}
+	m.current, m.next = current, next
+	return m, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *devCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.current, nil
+}
+
+// Run promotes the next certificate shortly before the current one expires
+// and generates a fresh successor. It returns when ctx is cancelled.
+func (m *devCertManager) Run(ctx context.Context) {
+	for {
+		m.mutex.RLock()
+		renewAt := m.current.Leaf.NotAfter.Add(-devCertRenewBefore)
+		m.mutex.RUnlock()
+
+		timer := time.NewTimer(time.Until(renewAt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := m.rotate(); err != nil {
+			log.Printf("[WARN] Dev certificate rotation failed, retrying in 1 minute: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}
+}
+
+// rotate makes the next certificate current and prepares a new successor.
+func (m *devCertManager) rotate() error {
+	m.mutex.RLock()
+	next := m.next
+	m.mutex.RUnlock()
+
+	successor, err := generateDevCert(m.hosts, next.Leaf.NotAfter.Add(-devCertRenewBefore))
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.current, m.next = next, successor
+	m.mutex.Unlock()
+
+	log.Printf("Rotated dev certificate, new hash %x valid until %s",
+		certHash(next), next.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// ServeHTTP returns the pinned hashes as JSON. The response is readable from
+// any origin so that the client page can fetch it before connecting.
+func (m *devCertManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mutex.RLock()
+	certs := []*tls.Certificate{m.current, m.next}
+	m.mutex.RUnlock()
+
+	hashes := make([]map[string]interface{}, 0, len(certs))
+	for _, c := range certs {
+		hashes = append(hashes, map[string]interface{}{
+			"algorithm":  "sha-256",
+			"value":      certHash(c),
+			"not_before": c.Leaf.NotBefore.Format(time.RFC3339),
+			"not_after":  c.Leaf.NotAfter.Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"hashes": hashes})
+}
+
+// certHash returns the SHA-256 hash of the DER-encoded leaf certificate,
+// which is what WebTransport's serverCertificateHashes compares against.
+func certHash(c *tls.Certificate) []byte {
+	sum := sha256.Sum256(c.Leaf.Raw)
+	return sum[:]
+}
+
+// generateDevCert creates a self-signed ECDSA P-256 certificate valid from
+// start (minus a small backdate) for devCertValidity.
+func generateDevCert(hosts []string, start time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %w", err)
+	}
+
+	notBefore := start.Add(-devCertBackdate)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "WebTransport chat dev certificate"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(devCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// devCertHosts returns the names the dev certificate is issued for: the
+// loopback names plus the host part of the listen address, if any.
+func devCertHosts(listenAddr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil && host != "" {
+		for _, h := range hosts {
+			if h == host {
+				return hosts
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
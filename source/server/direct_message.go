@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// maxDirectRecipients limits how many users a single direct message may target.
+const maxDirectRecipients = 20
+
+// FindClientsByName resolves display names (case-insensitive) to connected
+// clients and returns the names that matched nobody.
+func (m *MessageServer) FindClientsByName(names []string) (found []*Client, missing []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	byName := make(map[string]*Client, len(m.listeners))
+	for _, c := range m.listeners {
+		byName[strings.ToLower(c.Name)] = c
+	}
+	seen := make(map[int]bool, len(names))
+	for _, name := range names {
+		c, ok := byName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			found = append(found, c)
+		}
+	}
+	return found, missing
+}
+
+// SendDirect stamps a direct message with an id and server time and delivers
+// it to the recipients, echoing it back to the sender.
+func (m *MessageServer) SendDirect(sender *Client, recipients []*Client, event map[string]interface{}) {
+	m.mutex.Lock()
+	message := m.stampLocked("", event)
+	if message == nil {
+		m.mutex.Unlock()
+		return
+	}
+	subjects := make(map[string]bool, len(recipients))
+	for _, r := range recipients {
+		subjects[r.Principal.Subject] = true
+	}
+	m.receipts.track(event, sender.Principal.Subject, "", subjects)
+
+	// The sender gets the echo first; sending to oneself delivers it once
+	targets := []*Client{sender}
+	for _, c := range recipients {
+		if _, ok := m.listeners[c.ID]; ok && c.ID != sender.ID {
+			targets = append(targets, c)
+		}
+	}
+	m.deliverAndUnlock(targets, outboundMessage{data: message})
+}
+
+// parseRecipients accepts the "to" field as a single name or a list of names.
+func parseRecipients(raw interface{}) ([]string, error) {
+	var names []string
+	switch v := raw.(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			name, ok := item.(string)
+			if !ok {
+				return nil, errors.New("recipients must be names")
+			}
+			names = append(names, name)
+		}
+	default:
+		return nil, errors.New(`"to" must be a name or a list of names`)
+	}
+
+	var cleaned []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			cleaned = append(cleaned, name)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, errors.New("no recipients given")
+	}
+	if len(cleaned) > maxDirectRecipients {
+		return nil, fmt.Errorf("too many recipients (max %d)", maxDirectRecipients)
+	}
+	return cleaned, nil
+}
+
+// handleDirectMessage delivers a chat message only to the named recipients
+// and echoes it back to the sender. Recipients that are not online are
+// reported to the sender with an error event.
+func handleDirectMessage(server *MessageServer, client *Client, msg map[string]interface{}) {
+	names, err := parseRecipients(msg["to"])
+	if err != nil {
+		server.sendError(client, "dm", err)
+		return
+	}
+
+	recipients, missing := server.FindClientsByName(names)
+	if len(missing) > 0 {
+		errMsg, _ := json.Marshal(map[string]interface{}{
+			"type":       "error",
+			"request":    "dm",
+			"error":      "recipient not online: " + strings.Join(missing, ", "),
+			"recipients": missing,
+		})
+		server.SendMessage(client, errMsg)
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	to := make([]map[string]interface{}, 0, len(recipients))
+	for _, r := range recipients {
+		to = append(to, map[string]interface{}{"id": r.ID, "name": r.Name})
+	}
+	delete(msg, "channel")
+	msg["type"] = "dm"
+	msg["to"] = to
+	msg["name"] = client.Name
+	msg["sender_id"] = client.ID
+	server.SendDirect(client, recipients, msg)
+
+	log.Printf("[%s] Direct message delivered to %d recipients", client.Name, len(recipients))
+}
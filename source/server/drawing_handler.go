@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"io"
@@ -12,19 +13,18 @@ import (
 
 // drawingHeader defines the structure of the JSON header for drawing operations.
 type drawingHeader struct {
-	Op     string `json:"op"`
-	Size   int64  `json:"size,omitempty"`
-	Format string `json:"format,omitempty"`
+	Op      string `json:"op"`
+	Size    int64  `json:"size,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Channel string `json:"channel,omitempty"`
 }
 
-// handleDrawingStreamWithPeek handles drawing with already-read peek bytes
-func handleDrawingStreamWithPeek(server *MessageServer, client *Client, s *webtransport.Stream, peekData []byte) {
+// handleDrawingStream receives a drawing: a 4-byte big-endian header length,
+// the JSON header and then the PNG data.
+func handleDrawingStream(_ context.Context, server *MessageServer, client *Client, s *webtransport.Stream, r io.Reader) {
 	log.Printf("[%s] Drawing stream started", client.Name)
 
-	peekReader := &bytesReader{data: peekData}
-	fullStreamReader := io.MultiReader(peekReader, s)
-
-	br := bufio.NewReader(fullStreamReader)
+	br := bufio.NewReader(r)
 
 	// 1. Đọc 4 byte độ dài header (Big Endian)
 	headerLenBytes := make([]byte, 4)
@@ -35,7 +35,7 @@ func handleDrawingStreamWithPeek(server *MessageServer, client *Client, s *webtr
 	}
 	headerLength := uint32(headerLenBytes[0])<<24 | uint32(headerLenBytes[1])<<16 | uint32(headerLenBytes[2])<<8 | uint32(headerLenBytes[3])
 
-	if headerLength == 0 || headerLength > 16*1024 { // Giới hạn 16KB
+	if headerLength == 0 || int64(headerLength) > int64(server.config.MaxHeaderSize) {
 		log.Printf("[%s] Invalid header length: %d bytes", client.Name, headerLength)
 		writeDrawingJSONResult(s, map[string]string{"status": "error", "error": "invalid header length"})
 		return
@@ -63,8 +63,15 @@ func handleDrawingStreamWithPeek(server *MessageServer, client *Client, s *webtr
 		return
 	}
 
+	// Kiểm tra quyền gửi vào channel
+	channel, err := resolveChannel(server, client, hdr.Channel)
+	if err != nil {
+		writeDrawingJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+
 	// Kiểm tra size hợp lệ
-	if hdr.Size <= 0 || hdr.Size > 10*1024*1024 { // 10MB limit
+	if hdr.Size <= 0 || hdr.Size > int64(server.config.MaxDrawingSize) {
 		writeDrawingJSONResult(s, map[string]string{"status": "error", "error": "invalid drawing size"})
 		return
 	}
@@ -102,19 +109,15 @@ func handleDrawingStreamWithPeek(server *MessageServer, client *Client, s *webtr
 	}
 	log.Printf("[%s] Drawing response sent to client", client.Name)
 
-	msg, err := json.Marshal(map[string]interface{}{
-		"type": "drawing",
-		"name": client.Name,
-		"data": base64Data,
-	})
-
-	if err != nil {
-		log.Printf("[%s] ERROR: Failed to marshal broadcast drawing: %v", client.Name, err)
-		return // Không broadcast nếu lỗi
+	msg := map[string]interface{}{
+		"type":      "drawing",
+		"name":      client.Name,
+		"sender_id": client.ID,
+		"data":      base64Data,
 	}
 
 	// Chạy broadcast trong một goroutine riêng
-	go server.Broadcast(msg)
+	go server.BroadcastToChannel(channel, client, msg)
 
 	log.Printf("[%s] Drawing broadcast has been queued", client.Name)
 }
@@ -3,161 +3,523 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/quic-go/webtransport-go"
 )
 
 // fileStreamHeader defines the structure of the JSON header received on a file stream.
 type fileStreamHeader struct {
-	Op         string `json:"op"`
-	Filename   string `json:"filename"`
-	Size       int64  `json:"size,omitempty"`
-	Hash       string `json:"hash,omitempty"`
-	ChunkIndex int    `json:"chunk_index,omitempty"`
-	ChunkStart int64  `json:"chunk_start,omitempty"`
-	ChunkEnd   int64  `json:"chunk_end,omitempty"`
+	Op         string   `json:"op"`
+	Filename   string   `json:"filename"`
+	Size       int64    `json:"size,omitempty"`
+	Hash       string   `json:"hash,omitempty"`
+	UploadID   string   `json:"upload_id,omitempty"`
+	Offset     int64    `json:"offset,omitempty"`
+	PartSize   int64    `json:"part_size,omitempty"`
+	NumParts   int      `json:"num_parts,omitempty"`
+	PartHashes []string `json:"part_hashes,omitempty"`
+	ChunkIndex int      `json:"chunk_index,omitempty"`
+	ChunkStart int64    `json:"chunk_start,omitempty"`
+	ChunkEnd   int64    `json:"chunk_end,omitempty"`
+	Version    int      `json:"version,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+	NewName    string   `json:"new_name,omitempty"`
+
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
-// handleUpload handles upload with custom reader
-func handleUpload(client *Client, s *webtransport.Stream, hdr *fileStreamHeader, reader io.Reader) {
-	tempFile := filepath.Join("uploads", fmt.Sprintf("%s.part%d", hdr.Filename, hdr.ChunkIndex))
-	f, err := os.Create(tempFile)
+// handleBegin starts an upload session from the manifest in hdr: the total
+// size, the part count or part size (NumStreams parts by default) and
+// optional SHA-256 hashes of the file and of each part. Parts can then be
+// uploaded, and resumed, independently. If content with the declared hash
+// and size is already stored, the file is published right away instead.
+func handleBegin(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	manifest, err := newUploadManifest(hdr, int64(server.config.MaxFileSize), server.config.NumStreams)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+
+	if manifest.Hash != "" && server.blobs.Has(manifest.Hash, manifest.Size) {
+		channel, err := resolveChannel(server, client, hdr.Channel)
+		if err != nil {
+			writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+			return
+		}
+		mime, err := server.blobs.sniffBlob(manifest.Hash)
+		if err != nil {
+			log.Printf("[%s] Cannot detect the type of %s: %v", client.Name, manifest.Filename, err)
+		}
+		filename, version, err := server.publishFile(client, manifest.Filename, fileVersion{
+			Uploader:    client.Name,
+			UploaderID:  client.Principal.Subject,
+			Time:        time.Now().UTC(),
+			Size:        manifest.Size,
+			SHA256:      strings.ToLower(manifest.Hash),
+			MIME:        mime,
+			Description: manifest.Description,
+			Tags:        manifest.Tags,
+		})
+		switch {
+		case err == nil:
+			log.Printf("[%s] Content of %s is already stored, published as %s version %d without upload",
+				client.Name, manifest.Filename, filename, version.Version)
+			writeJSONResult(s, map[string]interface{}{
+				"status": "ok", "deduplicated": true, "filename": filename, "version": version.Version,
+				"bytes": manifest.Size, "sha256": version.SHA256,
+			})
+			server.announceFile(client, channel, filename, version)
+			return
+		case errors.Is(err, errBlobNotFound):
+			// Removed in the meantime; upload it after all
+		default:
+			writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+			return
+		}
+	}
+
+	u, err := server.uploads.Begin(client, manifest)
+	if err != nil {
+		log.Printf("[%s] Cannot begin upload of %s: %v", client.Name, hdr.Filename, err)
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+
+	log.Printf("[%s] Began upload %s of %s (%.2f MB in %d parts)",
+		client.Name, u.ID, u.Filename, float64(u.Size)/(1024*1024), u.NumParts)
+	writeJSONResult(s, map[string]interface{}{
+		"status":    "ok",
+		"upload_id": u.ID,
+		"num_parts": u.NumParts,
+		"part_size": u.PartSize,
+	})
+}
+
+// handleQuery reports how many bytes of each part of an upload the server
+// already holds, so that an interrupted upload can be resumed.
+func handleQuery(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	u, err := server.uploads.Get(hdr.UploadID, client)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	writeJSONResult(s, map[string]interface{}{
+		"status":     "ok",
+		"upload_id":  u.ID,
+		"filename":   u.Filename,
+		"size":       u.Size,
+		"num_parts":  u.NumParts,
+		"part_size":  u.PartSize,
+		"parts":      u.partStatus(),
+		"expires_at": server.uploads.ExpiresAt(u).UTC().Format(time.RFC3339),
+	})
+}
+
+// handleUpload writes data for one part of an upload session, starting at
+// hdr.Offset. Bytes are written straight to the local part file, so
+// whatever arrived before a dropped stream is kept and the client can
+// resume from the offset reported by a query. The part is hashed as it
+// streams in and, once complete, checked against hdr.Hash or the hash
+// declared by begin; a corrupt part is discarded at once so the client can
+// send it again, an intact one is put into storage.
+func handleUpload(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader, reader io.Reader) {
+	u, err := server.uploads.Get(hdr.UploadID, client)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	if hdr.ChunkIndex < 0 || hdr.ChunkIndex >= u.NumParts {
+		writeJSONResult(s, map[string]string{"status": "error", "error": fmt.Sprintf("chunk index %d out of range", hdr.ChunkIndex)})
+		return
+	}
+	release, err := u.acquirePart(hdr.ChunkIndex)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	defer release()
+
+	start, end := u.partRange(hdr.ChunkIndex)
+	partLen := end - start
+	have := u.received(hdr.ChunkIndex)
+	if hdr.Offset < 0 || hdr.Offset > have || hdr.Offset > partLen {
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "invalid offset", "chunk_index": hdr.ChunkIndex, "bytes": have,
+		})
+		return
+	}
+
+	expectedHash := ""
+	if len(u.PartHashes) > 0 {
+		expectedHash = strings.ToLower(u.PartHashes[hdr.ChunkIndex])
+	}
+	if hdr.Hash != "" {
+		if !sha256Pattern.MatchString(hdr.Hash) {
+			writeJSONResult(s, map[string]string{"status": "error", "error": "hash must be a hex SHA-256"})
+			return
+		}
+		if expectedHash != "" && !strings.EqualFold(hdr.Hash, expectedHash) {
+			writeJSONResult(s, map[string]interface{}{
+				"status": "error", "error": "chunk hash does not match the manifest", "chunk_index": hdr.ChunkIndex,
+			})
+			return
+		}
+		expectedHash = strings.ToLower(hdr.Hash)
+	}
+
+	if hdr.Offset == partLen && u.stored(hdr.ChunkIndex) {
+		// Nothing left to send; the client missed the earlier response
+		writeJSONResult(s, map[string]interface{}{
+			"status": "ok", "upload_id": u.ID, "chunk_index": hdr.ChunkIndex, "bytes": partLen, "complete": true,
+			"verified": u.partLeaf(hdr.ChunkIndex) != "",
+		})
+		return
+	}
+
+	partFile := u.partPath(hdr.ChunkIndex)
+	f, err := os.OpenFile(partFile, os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
 		writeJSONResult(s, map[string]string{"status": "error", "error": "cannot create temp file"})
 		return
 	}
 	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() < hdr.Offset {
+		// A part already put into a remote storage can only be sent again
+		// from the start
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "invalid offset", "chunk_index": hdr.ChunkIndex, "bytes": 0,
+		})
+		return
+	}
+	os.Remove(u.partStoredPath(hdr.ChunkIndex))
+	os.Remove(u.partHashPath(hdr.ChunkIndex)) // verified again once complete
 
-	if hdr.Size > 0 {
-		f.Truncate(hdr.Size) // Pre-allocate file size to reduce fragmentation
+	// Anything past the offset is rewritten by this stream
+	if err := f.Truncate(hdr.Offset); err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": "cannot resume part"})
+		return
+	}
+	// A resumed part is verified as a whole, so hash what is already held
+	h := sha256.New()
+	if expectedHash != "" && hdr.Offset > 0 {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, hdr.Offset)); err != nil {
+			writeJSONResult(s, map[string]string{"status": "error", "error": "cannot resume part"})
+			return
+		}
+	}
+	if _, err := f.Seek(hdr.Offset, io.SeekStart); err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": "cannot resume part"})
+		return
+	}
+	var dst io.Writer = f
+	if expectedHash != "" {
+		dst = io.MultiWriter(f, h)
 	}
 
-	log.Printf("⬆[%s] Receiving chunk %d for %s (%.2f MB)",
-		client.Name, hdr.ChunkIndex, hdr.Filename, float64(hdr.Size)/(1024*1024))
+	log.Printf("⬆[%s] Receiving part %d of upload %s (%s) from offset %d (%.2f MB)",
+		client.Name, hdr.ChunkIndex, u.ID, u.Filename, hdr.Offset, float64(partLen-hdr.Offset)/(1024*1024))
 
-	bufPtr := bufferPool.Get().(*[]byte)
-	defer bufferPool.Put(bufPtr)
+	bufPtr := server.bufferPool.Get().(*[]byte)
+	defer server.bufferPool.Put(bufPtr)
 
-	written, err := io.Copy(f, reader)
+	// Never accept more than the part holds, even if the client sends more
+	limited := io.LimitReader(reader, partLen-hdr.Offset+1)
+	written, err := io.CopyBuffer(dst, limited, *bufPtr)
+	f.Sync()
 	if err != nil {
-		writeJSONResult(s, map[string]string{"status": "error", "error": "failed to write chunk to disk"})
+		log.Printf("[%s] Part %d of upload %s interrupted after %d bytes: %v",
+			client.Name, hdr.ChunkIndex, u.ID, hdr.Offset+written, err)
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "failed to write chunk to disk", "chunk_index": hdr.ChunkIndex, "bytes": hdr.Offset + written,
+		})
+		return
+	}
+	if hdr.Offset+written > partLen {
+		f.Truncate(hdr.Offset)
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "chunk larger than its part", "chunk_index": hdr.ChunkIndex, "bytes": hdr.Offset,
+		})
 		return
 	}
-	f.Sync()
 
-	log.Printf("[%s] Finished receiving chunk %d (%s), %.2f MB written.",
-		client.Name, hdr.ChunkIndex, hdr.Filename, float64(written)/(1024*1024))
+	total := hdr.Offset + written
+	verified := false
+	if total == partLen && expectedHash != "" {
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != expectedHash {
+			f.Truncate(0)
+			log.Printf("[%s] Part %d of upload %s is corrupt. Expected: %s, Got: %s",
+				client.Name, hdr.ChunkIndex, u.ID, expectedHash, got)
+			writeJSONResult(s, map[string]interface{}{
+				"status": "error", "error": "chunk hash mismatch", "chunk_index": hdr.ChunkIndex, "bytes": 0,
+			})
+			return
+		}
+		verified = true
+		if len(u.PartHashes) == 0 {
+			// Remember the hash so that merge can check the part again
+			if err := os.WriteFile(u.partHashPath(hdr.ChunkIndex), []byte(expectedHash), 0o644); err != nil {
+				log.Printf("[%s] Cannot record hash of part %d of upload %s: %v", client.Name, hdr.ChunkIndex, u.ID, err)
+			}
+		}
+	}
+	if total == partLen {
+		f.Close()
+		err := server.storage.PutPart(u.partKey(hdr.ChunkIndex), partFile)
+		if err == nil {
+			err = os.WriteFile(u.partStoredPath(hdr.ChunkIndex), nil, 0o644)
+		}
+		if err != nil {
+			log.Printf("[%s] Cannot store part %d of upload %s: %v", client.Name, hdr.ChunkIndex, u.ID, err)
+			writeJSONResult(s, map[string]interface{}{
+				"status": "error", "error": "cannot store part", "chunk_index": hdr.ChunkIndex, "bytes": u.received(hdr.ChunkIndex),
+			})
+			return
+		}
+	}
+	log.Printf("[%s] Finished receiving part %d of upload %s, %d of %d bytes held.",
+		client.Name, hdr.ChunkIndex, u.ID, total, partLen)
 
 	writeJSONResult(s, map[string]interface{}{
 		"status":      "ok",
+		"upload_id":   u.ID,
 		"chunk_index": hdr.ChunkIndex,
-		"bytes":       written,
+		"bytes":       total,
+		"complete":    total == partLen,
+		"verified":    verified,
 	})
 }
 
-// handleMerge combines chunks into a final file and verifies it.
+// handleMerge verifies the parts of an upload session against its manifest
+// and combines them into the final file in storage. The manifest is the
+// part hashes declared by begin or verified on upload, combined into a
+// Merkle root, and the file hash.
+// Incomplete parts are reported so the client can resume them; parts whose
+// hash does not match are discarded and reported so the client can send
+// them again. If only the file hash fails, the parts without a known hash
+// are the ones discarded.
 func handleMerge(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
-	log.Printf("[%s] Starting merge for %s", client.Name, hdr.Filename)
-	finalFile := filepath.Join("uploads", hdr.Filename)
-	f, err := os.Create(finalFile)
+	channel, err := resolveChannel(server, client, hdr.Channel)
 	if err != nil {
-		writeJSONResult(s, map[string]string{"status": "error", "error": "cannot create final file"})
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
 		return
 	}
-	defer f.Close()
+	u, err := server.uploads.Get(hdr.UploadID, client)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	if err := u.startMerge(); err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	defer u.endMerge()
 
+	var incomplete []int
+	for i := 0; i < u.NumParts; i++ {
+		start, end := u.partRange(i)
+		if u.received(i) != end-start {
+			incomplete = append(incomplete, i)
+		}
+	}
+	if len(incomplete) > 0 {
+		log.Printf("[%s] Cannot merge upload %s: %d parts incomplete", client.Name, u.ID, len(incomplete))
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "upload incomplete", "incomplete": incomplete,
+		})
+		return
+	}
+
+	log.Printf("[%s] Starting merge of upload %s (%s)", client.Name, u.ID, u.Filename)
 	h := sha256.New()
-	multiWriter := io.MultiWriter(f, h)
-	bufPtr := bufferPool.Get().(*[]byte)
-	defer bufferPool.Put(bufPtr)
+	partHash := sha256.New()
+	var sniff sniffWriter
+	multiWriter := io.MultiWriter(h, partHash, &sniff)
+	bufPtr := server.bufferPool.Get().(*[]byte)
+	defer server.bufferPool.Put(bufPtr)
 
 	var totalBytes int64
-	for i := 0; i < NUM_STREAMS; i++ {
-		partFile := filepath.Join("uploads", fmt.Sprintf("%s.part%d", hdr.Filename, i))
-		pf, err := os.Open(partFile)
-		if err != nil {
-			log.Printf("[%s] Missing part %d for %s", client.Name, i, hdr.Filename)
-			writeJSONResult(s, map[string]string{"status": "error", "error": fmt.Sprintf("missing part %d", i)})
-			os.Remove(finalFile) // Clean up failed merge
-			return
+	var corrupt, unverified []int
+	var parts []string
+	leaves := make([]string, u.NumParts)
+	for i := 0; i < u.NumParts; i++ {
+		partHash.Reset()
+		// An empty part is never uploaded
+		if start, end := u.partRange(i); end > start {
+			r, err := server.storage.OpenRange(u.partKey(i), 0, -1)
+			if err != nil {
+				log.Printf("[%s] Missing part %d of upload %s: %v", client.Name, i, u.ID, err)
+				u.discardParts([]int{i})
+				writeJSONResult(s, map[string]interface{}{
+					"status": "error", "error": fmt.Sprintf("missing part %d", i), "incomplete": []int{i},
+				})
+				return
+			}
+			written, err := io.CopyBuffer(multiWriter, r, *bufPtr)
+			r.Close()
+			if err != nil {
+				log.Printf("[%s] Cannot read part %d of upload %s: %v", client.Name, i, u.ID, err)
+				writeJSONResult(s, map[string]string{"status": "error", "error": "failed during merge copy"})
+				return
+			}
+			totalBytes += written
+			parts = append(parts, u.partKey(i))
+			if written != end-start {
+				log.Printf("[%s] Part %d of upload %s has %d bytes instead of %d", client.Name, i, u.ID, written, end-start)
+				corrupt = append(corrupt, i)
+				continue
+			}
 		}
 
-		written, err := io.CopyBuffer(multiWriter, pf, *bufPtr)
-		pf.Close()
-		os.Remove(partFile)
-
-		if err != nil {
-			writeJSONResult(s, map[string]string{"status": "error", "error": "failed during merge copy"})
-			os.Remove(finalFile) // Clean up failed merge
-			return
+		leaves[i] = fmt.Sprintf("%x", partHash.Sum(nil))
+		switch leaf := u.partLeaf(i); {
+		case leaf == "":
+			unverified = append(unverified, i)
+		case leaf != leaves[i]:
+			log.Printf("[%s] Part %d of upload %s does not match its declared hash", client.Name, i, u.ID)
+			corrupt = append(corrupt, i)
 		}
-		totalBytes += written
 	}
-	f.Sync()
 
-	// Verify hash if provided
-	if hdr.Hash != "" {
-		calculatedHash := fmt.Sprintf("%x", h.Sum(nil))
-		if !strings.EqualFold(calculatedHash, hdr.Hash) {
-			os.Remove(finalFile)
-			log.Printf("[%s] Hash mismatch for %s. Expected: %s, Got: %s", client.Name, hdr.Filename, hdr.Hash, calculatedHash)
+	if len(corrupt) > 0 {
+		u.discardParts(corrupt)
+		writeJSONResult(s, map[string]interface{}{
+			"status": "error", "error": "part hash mismatch", "incomplete": corrupt,
+		})
+		return
+	}
+
+	// Verify the whole file against the hash given to begin or merge
+	expectedHash := hdr.Hash
+	if expectedHash == "" {
+		expectedHash = u.Hash
+	}
+	calculatedHash := fmt.Sprintf("%x", h.Sum(nil))
+	if expectedHash != "" {
+		if !strings.EqualFold(calculatedHash, expectedHash) {
+			log.Printf("[%s] Hash mismatch for %s. Expected: %s, Got: %s", client.Name, u.Filename, expectedHash, calculatedHash)
+			if len(unverified) > 0 {
+				// Every part with a known hash is intact, so the fault
+				// lies among the others
+				u.discardParts(unverified)
+				writeJSONResult(s, map[string]interface{}{
+					"status": "error", "error": "file hash mismatch", "incomplete": unverified,
+				})
+				return
+			}
+			server.uploads.Remove(u)
 			writeJSONResult(s, map[string]string{"status": "error", "error": "file hash mismatch"})
 			return
 		}
-		log.Printf("[%s] Hash matched for %s", client.Name, hdr.Filename)
+		log.Printf("[%s] Hash matched for %s", client.Name, u.Filename)
+	}
+
+	// The file is only stored once it is complete and verified. The stored
+	// content is reserved until it has been published, or found not needed
+	if err := server.blobs.Compose(calculatedHash, parts); err != nil {
+		log.Printf("[%s] Cannot store %s: %v", client.Name, u.Filename, err)
+		writeJSONResult(s, map[string]string{"status": "error", "error": "cannot store file"})
+		return
+	}
+	filename, version, err := server.publishFile(client, u.Filename, fileVersion{
+		Uploader:    client.Name,
+		UploaderID:  client.Principal.Subject,
+		Time:        time.Now().UTC(),
+		Size:        totalBytes,
+		SHA256:      calculatedHash,
+		MIME:        sniff.mimeType(),
+		Description: u.Description,
+		Tags:        u.Tags,
+	})
+	server.blobs.Release(calculatedHash)
+	if err != nil {
+		log.Printf("[%s] Cannot publish %s: %v", client.Name, u.Filename, err)
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
 	}
+	server.uploads.Remove(u)
 
-	log.Printf("[%s] Merge complete: %s (%.2f MB)", client.Name, hdr.Filename, float64(totalBytes)/(1024*1024))
-	writeJSONResult(s, map[string]interface{}{"status": "ok", "filename": hdr.Filename, "bytes": totalBytes})
+	log.Printf("[%s] Merge complete: %s version %d (%.2f MB)", client.Name, filename, version.Version, float64(totalBytes)/(1024*1024))
+	writeJSONResult(s, map[string]interface{}{
+		"status": "ok", "filename": filename, "version": version.Version, "bytes": totalBytes, "sha256": calculatedHash,
+		"root": merkleRoot(leaves),
+	})
 
-	// Notify all clients of the new file
+	server.announceFile(client, channel, filename, version)
+}
+
+// announceFile notifies all clients of a newly published file: everyone
+// gets the change to the file list and channel gets a file event.
+func (m *MessageServer) announceFile(client *Client, channel, filename string, v fileVersion) {
 	go func() {
-		server.BroadcastFileList()
-		msg, _ := json.Marshal(map[string]interface{}{
-			"type": "file", "name": client.Name, "filename": hdr.Filename, "size": totalBytes,
+		m.BroadcastFileListDelta(filename)
+		m.BroadcastToChannel(channel, client, map[string]interface{}{
+			"type": "file", "name": client.Name, "sender_id": client.ID, "filename": filename, "size": v.Size,
+			"version": v.Version,
 		})
-		server.Broadcast(msg)
 	}()
 }
 
-// handleDownload processes a request to download a file chunk.
-func handleDownload(client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
-	fpath := filepath.Join("uploads", hdr.Filename)
-	f, err := os.Open(fpath)
+// handleDownload processes a request to download a file chunk. Version
+// selects an older version of the file; without it the current version is
+// sent. The metadata response names the version so that the client can
+// request every chunk from the same one.
+func handleDownload(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	version, err := server.findFileVersion(hdr.Filename, hdr.Version)
+	if errors.Is(err, errVersionNotFound) {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
 	if err != nil {
 		writeJSONResult(s, map[string]string{"status": "error", "error": "file not found"})
 		return
 	}
-	defer f.Close()
-
-	info, _ := f.Stat()
-	fileSize := info.Size()
+	fileSize := version.Size
 
 	// Handle initial metadata request
 	if hdr.ChunkIndex == -1 {
-		log.Printf("[%s] Sending metadata for %s (%.2f MB)", client.Name, hdr.Filename, float64(fileSize)/(1024*1024))
-		writeJSONResult(s, map[string]interface{}{
-			"status": "ok", "filename": hdr.Filename, "size": fileSize, "num_streams": NUM_STREAMS,
-		})
+		log.Printf("[%s] Sending metadata for %s version %d (%.2f MB)", client.Name, hdr.Filename, version.Version, float64(fileSize)/(1024*1024))
+		meta := map[string]interface{}{
+			"status": "ok", "filename": hdr.Filename, "size": fileSize, "num_streams": server.config.NumStreams,
+			"version": version.Version,
+		}
+		if version.SHA256 != "" {
+			meta["sha256"] = version.SHA256
+		}
+		writeJSONResult(s, meta)
 		return
 	}
 
 	// Send the requested chunk
-	chunkSize := hdr.ChunkEnd - hdr.ChunkStart
+	chunkEnd := min(hdr.ChunkEnd, fileSize)
+	if hdr.ChunkStart < 0 || hdr.ChunkStart > chunkEnd {
+		log.Printf("[%s] Invalid range for chunk %d of %s", client.Name, hdr.ChunkIndex, hdr.Filename)
+		return
+	}
+	chunkSize := chunkEnd - hdr.ChunkStart
 	log.Printf("[%s] Sending chunk %d of %s (%.2f MB)",
 		client.Name, hdr.ChunkIndex, hdr.Filename, float64(chunkSize)/(1024*1024))
 
-	bufPtr := bufferPool.Get().(*[]byte)
-	defer bufferPool.Put(bufPtr)
+	r, err := server.blobs.Open(version.SHA256, hdr.ChunkStart, chunkSize)
+	if err != nil {
+		log.Printf("[%s] Cannot open %s version %d: %v", client.Name, hdr.Filename, version.Version, err)
+		return
+	}
+	defer r.Close()
+
+	bufPtr := server.bufferPool.Get().(*[]byte)
+	defer server.bufferPool.Put(bufPtr)
 
-	sectionReader := io.NewSectionReader(f, hdr.ChunkStart, chunkSize)
-	sent, err := io.CopyBuffer(s, sectionReader, *bufPtr)
+	sent, err := io.CopyBuffer(s, r, *bufPtr)
 	if err != nil {
 		log.Printf("[%s] Error sending chunk %d: %v", client.Name, hdr.ChunkIndex, err)
 		return
@@ -166,6 +528,33 @@ func handleDownload(client *Client, s *webtransport.Stream, hdr *fileStreamHeade
 	log.Printf("[%s] Finished sending chunk %d: %.2f MB", client.Name, hdr.ChunkIndex, float64(sent)/(1024*1024))
 }
 
+// partFilePattern matches the temporary files written next to the final
+// file by servers that predate upload sessions.
+var partFilePattern = regexp.MustCompile(`\.part\d+$`)
+
+// removeStalePartFiles deletes such leftover parts and returns how many were
+// removed. Parts of upload sessions live under uploadsDirName instead.
+func removeStalePartFiles(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading upload directory %q: %v", dir, err)
+		return 0
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !partFilePattern.MatchString(e.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			log.Printf("Failed to remove stale part %s: %v", e.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
 // writeJSONResult marshals a struct to JSON and writes it to the stream.
 func writeJSONResult(w io.Writer, v interface{}) {
 	b, _ := json.Marshal(v)
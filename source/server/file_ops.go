@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Edit policies deciding who may publish new versions of, delete or rename
+// a shared file.
+const (
+	editOwner  = "owner"  // whoever first published the file, or an admin
+	editAdmin  = "admin"  // admins only
+	editAnyone = "anyone" // every client
+)
+
+var editPolicies = []string{editOwner, editAdmin, editAnyone}
+
+var errEditNotAllowed = errors.New("not allowed to change this file")
+
+// canEdit reports whether client may change the file with version index
+// idx. Under the owner policy the owner is recorded in the index when the
+// file is first published; files without one, imported from releases that
+// kept no uploader, may only be changed by admins.
+func (m *MessageServer) canEdit(client *Client, idx versionIndex) bool {
+	switch m.config.FileEditPolicy {
+	case editAnyone:
+		return true
+	case editOwner:
+		if idx.Owner != "" && idx.Owner == client.Principal.Subject {
+			return true
+		}
+	}
+	return client.Principal.IsAdmin()
+}
+
+// deleteFile removes the file called name with all its versions on behalf
+// of client. Content no other file refers to is deleted with it.
+func (m *MessageServer) deleteFile(client *Client, name string) error {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	idx, err := m.fileIndexLocked(name)
+	if err != nil {
+		return err
+	}
+	if !m.canEdit(client, idx) {
+		return errEditNotAllowed
+	}
+	if err := m.storage.Delete(versionKey(name)); err != nil {
+		return err
+	}
+	os.Remove(versionsDir(m.config.UploadDir, name)) // left empty by the local backend
+	m.setCatalogLocked(name, versionIndex{})
+	m.saveCatalogLocked()
+	for _, v := range idx.Versions {
+		m.blobs.Unref(v.SHA256)
+	}
+	return nil
+}
+
+// renameFile moves the file called name, with all its versions, to newName
+// on behalf of client. The new index is written before the old one is
+// removed, so the file never disappears; the content is not touched.
+func (m *MessageServer) renameFile(client *Client, name, newName string) error {
+	if newName == "" || newName == "." {
+		return errors.New("new name is required")
+	}
+
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	idx, err := m.fileIndexLocked(name)
+	if err != nil {
+		return err
+	}
+	if !m.canEdit(client, idx) {
+		return errEditNotAllowed
+	}
+	if _, ok := m.catalog[newName]; ok {
+		return errFileExists
+	}
+	if err := m.writeIndex(newName, idx); err != nil {
+		return err
+	}
+	if err := m.storage.Delete(versionKey(name)); err != nil {
+		// Both names would refer to the same content with one reference
+		m.storage.Delete(versionKey(newName))
+		return err
+	}
+	os.Remove(versionsDir(m.config.UploadDir, name))
+	m.setCatalogLocked(newName, idx)
+	m.setCatalogLocked(name, versionIndex{})
+	m.saveCatalogLocked()
+	return nil
+}
+
+// announceFileChange notifies all clients that the files called names
+// were changed and posts notice to channel.
+func (m *MessageServer) announceFileChange(channel, notice string, names ...string) {
+	go func() {
+		m.BroadcastFileListDelta(names...)
+		m.BroadcastToChannel(channel, nil, map[string]interface{}{"type": "system", "message": notice})
+	}()
+}
+
+// fileOpError is the error reported to the client for a failed delete,
+// rename or stat of a file.
+func fileOpError(err error) string {
+	if errors.Is(err, os.ErrNotExist) {
+		return "file not found"
+	}
+	return err.Error()
+}
+
+// handleStat describes a file: its current version, when it was first
+// published and by whom, and whether the client may change it.
+func handleStat(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	server.publishMutex.Lock()
+	idx, err := server.fileIndexLocked(hdr.Filename)
+	server.publishMutex.Unlock()
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": fileOpError(err)})
+		return
+	}
+
+	result := idx.Versions[len(idx.Versions)-1].public()
+	result["status"] = "ok"
+	result["filename"] = hdr.Filename
+	result["versions"] = len(idx.Versions)
+	result["created"] = idx.Created.UTC().Format(time.RFC3339)
+	if idx.OwnerName != "" {
+		result["owner"] = idx.OwnerName
+	}
+	result["can_edit"] = server.canEdit(client, idx)
+	writeJSONResult(s, result)
+}
+
+// handleDelete deletes a file with all its versions and announces it in
+// the channel named by the header.
+func handleDelete(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	channel, err := resolveChannel(server, client, hdr.Channel)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	if err := server.deleteFile(client, hdr.Filename); err != nil {
+		log.Printf("[%s] Cannot delete %s: %v", client.Name, hdr.Filename, err)
+		writeJSONResult(s, map[string]string{"status": "error", "error": fileOpError(err)})
+		return
+	}
+
+	log.Printf("[%s] Deleted %s", client.Name, hdr.Filename)
+	writeJSONResult(s, map[string]interface{}{"status": "ok", "filename": hdr.Filename})
+	server.announceFileChange(channel, fmt.Sprintf("%s deleted %s.", client.Name, hdr.Filename), hdr.Filename)
+}
+
+// handleRename renames a file to the header's new_name and announces it in
+// the channel named by the header.
+func handleRename(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	channel, err := resolveChannel(server, client, hdr.Channel)
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	newName := sanitizeFilename(hdr.NewName)
+	if err := server.renameFile(client, hdr.Filename, newName); err != nil {
+		log.Printf("[%s] Cannot rename %s to %s: %v", client.Name, hdr.Filename, newName, err)
+		writeJSONResult(s, map[string]string{"status": "error", "error": fileOpError(err)})
+		return
+	}
+
+	log.Printf("[%s] Renamed %s to %s", client.Name, hdr.Filename, newName)
+	writeJSONResult(s, map[string]interface{}{"status": "ok", "filename": hdr.Filename, "new_name": newName})
+	server.announceFileChange(channel, fmt.Sprintf("%s renamed %s to %s.", client.Name, hdr.Filename, newName),
+		hdr.Filename, newName)
+}
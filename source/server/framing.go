@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every server-to-client event on the persistent stream is sent as one
+// frame: a 4-byte big-endian payload length followed by the JSON payload.
+// QUIC may split or coalesce writes arbitrarily, so readers must reassemble
+// frames from the length prefix rather than rely on read boundaries.
+const frameHeaderLen = 4
+
+// maxFrameSize is the largest frame payload the framing layer accepts.
+const maxFrameSize = 1<<32 - 1
+
+// errFrameTooLarge is returned by FrameReader for frames above its limit.
+var errFrameTooLarge = errors.New("frame too large")
+
+// encodeFrame returns payload prefixed with its length, ready to be sent
+// with a single Write.
+func encodeFrame(payload []byte) ([]byte, error) {
+	if uint64(len(payload)) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderLen:], payload)
+	return frame, nil
+}
+
+// writeFrame writes payload as one frame.
+func writeFrame(w io.Writer, payload []byte) error {
+	frame, err := encodeFrame(payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// FrameReader decodes frames from a stream, however the underlying reads
+// are fragmented.
+type FrameReader struct {
+	r       io.Reader
+	maxSize int
+	header  [frameHeaderLen]byte
+}
+
+// NewFrameReader returns a reader that rejects frames larger than maxSize.
+func NewFrameReader(r io.Reader, maxSize int) *FrameReader {
+	return &FrameReader{r: r, maxSize: maxSize}
+}
+
+// Next returns the payload of the next frame. It returns io.EOF at a clean
+// end of stream and io.ErrUnexpectedEOF if the stream ends inside a frame.
+func (f *FrameReader) Next() ([]byte, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(f.header[:])
+	if uint64(n) > uint64(f.maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", errFrameTooLarge, n, f.maxSize)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// randomReader returns between 1 and max bytes per Read, as a QUIC stream
+// may when it splits or coalesces writes.
+type randomReader struct {
+	r   io.Reader
+	rnd *rand.Rand
+	max int
+}
+
+func (r *randomReader) Read(p []byte) (int, error) {
+	if n := 1 + r.rnd.Intn(r.max); n < len(p) {
+		p = p[:n]
+	}
+	return r.r.Read(p)
+}
+
+// testPayloads covers an empty frame, frames shorter than the header and
+// frames spanning many reads.
+func testPayloads() [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	payloads := [][]byte{{}, []byte("{}"), []byte(`{"type":"chat","message":"xin chào"}`)}
+	for _, n := range []int{1, 3, 4, 5, 1000, 70000} {
+		p := make([]byte, n)
+		rnd.Read(p)
+		payloads = append(payloads, p)
+	}
+	return payloads
+}
+
+func encodeStream(t *testing.T, payloads [][]byte) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	for _, p := range payloads {
+		if err := writeFrame(&stream, p); err != nil {
+			t.Fatalf("writeFrame(%d bytes): %v", len(p), err)
+		}
+	}
+	return stream.Bytes()
+}
+
+func TestFrameReaderReassemblesFragmentedReads(t *testing.T) {
+	payloads := testPayloads()
+	stream := encodeStream(t, payloads)
+
+	readers := map[string]func() io.Reader{
+		"whole":    func() io.Reader { return bytes.NewReader(stream) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) },
+		"random": func() io.Reader {
+			return &randomReader{r: bytes.NewReader(stream), rnd: rand.New(rand.NewSource(2)), max: 37}
+		},
+		"random large": func() io.Reader {
+			return &randomReader{r: bytes.NewReader(stream), rnd: rand.New(rand.NewSource(3)), max: 9000}
+		},
+	}
+	for name, newReader := range readers {
+		t.Run(name, func(t *testing.T) {
+			fr := NewFrameReader(newReader(), 1<<20)
+			for i, want := range payloads {
+				got, err := fr.Next()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("frame %d: got %d bytes, want %d bytes", i, len(got), len(want))
+				}
+			}
+			if _, err := fr.Next(); err != io.EOF {
+				t.Fatalf("after the last frame: got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestFrameReaderTruncatedFrame(t *testing.T) {
+	frame, err := encodeFrame([]byte(`{"type":"chat"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut inside the header and inside the payload
+	for _, n := range []int{1, frameHeaderLen - 1, frameHeaderLen, len(frame) - 1} {
+		fr := NewFrameReader(iotest.OneByteReader(bytes.NewReader(frame[:n])), 1<<20)
+		if _, err := fr.Next(); err != io.ErrUnexpectedEOF {
+			t.Errorf("frame cut after %d bytes: got %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+func TestFrameReaderTooLarge(t *testing.T) {
+	stream := encodeStream(t, [][]byte{make([]byte, 100), make([]byte, 101)})
+	fr := NewFrameReader(bytes.NewReader(stream), 100)
+	if _, err := fr.Next(); err != nil {
+		t.Fatalf("frame at the limit: %v", err)
+	}
+	if _, err := fr.Next(); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("frame above the limit: got %v, want errFrameTooLarge", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// protocolVersion is the revision of the client/server protocol spoken by
+// this server. Clients older than minProtocolVersion are refused.
+//
+// Version 1: framed persistent stream, stream-type byte on bidirectional
+// streams, server-assigned event ids.
+// Version 2: uploads go through upload sessions (begin, query, resumable
+// parts); part uploads without an upload_id are no longer accepted.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+)
+
+// helloTimeout is how long a new session may take to send its hello.
+const helloTimeout = 10 * time.Second
+
+// serverFeatures are the optional capabilities this server offers. The
+// welcome message lists those the client also asked for.
+var serverFeatures = []string{"channels", "dm", "file_list_delta", "history", "presence", "receipts", "typing"}
+
+// helloMessage is the first message a client sends, on its own
+// unidirectional stream: {"type":"hello","protocol_version":2,"features":[...]}.
+type helloMessage struct {
+	Type            string   `json:"type"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features"`
+}
+
+// errIncompatible is wrapped by awaitHello when the client cannot be served.
+var errIncompatible = errors.New("incompatible client")
+
+// awaitHello reads and validates the client's hello.
+func awaitHello(ctx context.Context, session *webtransport.Session, maxSize int) (*helloMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+
+	stream, err := session.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no hello received: %w", err)
+	}
+	stream.SetReadDeadline(time.Now().Add(helloTimeout))
+	data, err := io.ReadAll(io.LimitReader(stream, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading hello: %w", err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: hello too large", errIncompatible)
+	}
+
+	var hello helloMessage
+	if err := json.Unmarshal(data, &hello); err != nil || hello.Type != "hello" {
+		return nil, fmt.Errorf("%w: expected a hello message first, please reload the page", errIncompatible)
+	}
+	if hello.ProtocolVersion < minProtocolVersion || hello.ProtocolVersion > protocolVersion {
+		return nil, fmt.Errorf("%w: protocol version %d is not supported (server supports %d-%d), please reload the page",
+			errIncompatible, hello.ProtocolVersion, minProtocolVersion, protocolVersion)
+	}
+	return &hello, nil
+}
+
+// negotiateFeatures returns the features both sides support, sorted.
+func negotiateFeatures(requested []string) map[string]bool {
+	offered := make(map[string]bool, len(serverFeatures))
+	for _, f := range serverFeatures {
+		offered[f] = true
+	}
+	features := make(map[string]bool)
+	for _, f := range requested {
+		if offered[f] {
+			features[f] = true
+		}
+	}
+	return features
+}
+
+// welcomeMessage answers a hello with the negotiated protocol and the
+// limits the client must respect.
+func (m *MessageServer) welcomeMessage(features map[string]bool) []byte {
+	names := make([]string, 0, len(features))
+	for f := range features {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":             "welcome",
+		"protocol_version": protocolVersion,
+		"features":         names,
+		"limits": map[string]interface{}{
+			"max_file_size":    m.config.MaxFileSize,
+			"max_drawing_size": m.config.MaxDrawingSize,
+			"max_header_size":  m.config.MaxHeaderSize,
+			"num_streams":      m.config.NumStreams,
+			"max_upload_parts": maxUploadParts,
+			"chunk_size":       m.config.ChunkSize,
+		},
+	})
+	return msg
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxHistoryPage is the largest number of events returned by one history
+// request.
+const maxHistoryPage = 200
+
+// historyIndexEntry locates one stored event inside the log file.
+type historyIndexEntry struct {
+	id      int64
+	time    time.Time
+	channel string
+	offset  int64
+	length  int64
+
+	// placeholder is what history pages return instead of the stored
+	// event for drawings: the event without its image data.
+	placeholder []byte
+}
+
+// drawingPlaceholder returns the event that stands in for a stored drawing
+// in history pages: the drawing without its data, which can be up to
+// MaxDrawingSize and is fetched separately with a "drawing_data" request.
+// It returns nil for other events.
+func drawingPlaceholder(event map[string]interface{}) []byte {
+	if event["type"] != "drawing" {
+		return nil
+	}
+	placeholder := make(map[string]interface{}, len(event))
+	for k, v := range event {
+		placeholder[k] = v
+	}
+	delete(placeholder, "data")
+	placeholder["data_omitted"] = true
+	data, _ := json.Marshal(placeholder)
+	return data
+}
+
+// History is a durable, append-only log of channel events (chat, system,
+// file and drawing). Every event is stored as one JSON line; only an index
+// of ids, channels and file offsets is kept in memory, so large drawings
+// are read back from disk on demand.
+//
+// Direct messages and server-wide notices get ids from the same sequence
+// but are not written to the log. On Close a line holding only the last id
+// is appended, so ids are not reused after a restart.
+type History struct {
+	mutex    sync.Mutex
+	file     *os.File
+	index    []historyIndexEntry // ordered by id
+	size     int64
+	lastID   int64
+	loggedID int64 // highest id written to the log
+}
+
+// OpenHistory opens (or creates) the log at path and rebuilds the index.
+// A truncated last line, left behind by a crash mid-write, is discarded.
+func OpenHistory(path string) (*History, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history file: %w", err)
+	}
+
+	h := &History{file: f}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("[WARN] Discarding %d bytes of incomplete history at offset %d", len(line), h.size)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading history file: %w", err)
+		}
+
+		var meta struct {
+			ID      int64     `json:"id"`
+			Time    time.Time `json:"time"`
+			Channel string    `json:"channel"`
+			Type    string    `json:"type"`
+		}
+		if err := json.Unmarshal(line, &meta); err != nil || meta.ID <= h.lastID {
+			log.Printf("[WARN] Skipping malformed history entry at offset %d", h.size)
+		} else {
+			// Lines without a channel only advance the id sequence
+			if meta.Channel != "" {
+				entry := historyIndexEntry{
+					id:      meta.ID,
+					time:    meta.Time,
+					channel: meta.Channel,
+					offset:  h.size,
+					length:  int64(len(line)) - 1,
+				}
+				if meta.Type == "drawing" {
+					var event map[string]interface{}
+					if json.Unmarshal(line, &event) == nil {
+						entry.placeholder = drawingPlaceholder(event)
+					}
+				}
+				h.index = append(h.index, entry)
+			}
+			h.lastID = meta.ID
+		}
+		h.size += int64(len(line))
+	}
+
+	if err := f.Truncate(h.size); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncating history file: %w", err)
+	}
+	h.loggedID = h.lastID
+	return h, nil
+}
+
+// Append assigns the next id and the current server time to event, an
+// event of channel, writes it to the log and returns the encoded event.
+func (h *History) Append(channel string, event map[string]interface{}) ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now().UTC()
+	event["id"] = h.lastID + 1
+	event["time"] = now.Format(time.RFC3339Nano)
+	event["channel"] = channel
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := h.file.WriteAt(append(data, '\n'), h.size); err != nil {
+		// Leave the index untouched; a partial line is dropped on next start
+		return nil, fmt.Errorf("writing history: %w", err)
+	}
+	h.lastID++
+	h.loggedID = h.lastID
+	h.index = append(h.index, historyIndexEntry{
+		id:          h.lastID,
+		time:        now,
+		channel:     channel,
+		offset:      h.size,
+		length:      int64(len(data)),
+		placeholder: drawingPlaceholder(event),
+	})
+	h.size += int64(len(data)) + 1
+	return data, nil
+}
+
+// Stamp assigns the next id and the current server time to event, a direct
+// message or server-wide notice, and returns the encoded event. Such events
+// are not written to the log.
+func (h *History) Stamp(event map[string]interface{}) ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	event["id"] = h.lastID + 1
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	h.lastID++
+	return data, nil
+}
+
+// HistoryQuery selects a page of a channel's history. Events strictly older
+// than BeforeID and/or Before are returned, newest page first; zero values
+// mean "from the latest event".
+type HistoryQuery struct {
+	Channel  string
+	BeforeID int64
+	Before   time.Time
+	Limit    int
+}
+
+// Page returns up to q.Limit events in chronological order, and whether
+// older events remain. Drawings are returned without their data.
+func (h *History) Page(q HistoryQuery) ([]json.RawMessage, bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	end := len(h.index)
+	if q.BeforeID > 0 {
+		end = sort.Search(len(h.index), func(i int) bool { return h.index[i].id >= q.BeforeID })
+	}
+	if !q.Before.IsZero() {
+		if i := sort.Search(end, func(i int) bool { return !h.index[i].time.Before(q.Before) }); i < end {
+			end = i
+		}
+	}
+
+	var picked []historyIndexEntry
+	i := end - 1
+	for ; i >= 0 && len(picked) < q.Limit; i-- {
+		if h.index[i].channel == q.Channel {
+			picked = append(picked, h.index[i])
+		}
+	}
+	more := false
+	for ; i >= 0; i-- {
+		if h.index[i].channel == q.Channel {
+			more = true
+			break
+		}
+	}
+
+	events := make([]json.RawMessage, len(picked))
+	for j, e := range picked {
+		if e.placeholder != nil {
+			events[len(picked)-1-j] = e.placeholder
+			continue
+		}
+		buf, err := h.readLocked(e)
+		if err != nil {
+			return nil, false, err
+		}
+		events[len(picked)-1-j] = buf
+	}
+	return events, more, nil
+}
+
+// Event returns the stored event id of channel, or an os.ErrNotExist error
+// if channel has no such event.
+func (h *History) Event(channel string, id int64) (json.RawMessage, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := sort.Search(len(h.index), func(i int) bool { return h.index[i].id >= id })
+	if i == len(h.index) || h.index[i].id != id || h.index[i].channel != channel {
+		return nil, fmt.Errorf("history entry %d: %w", id, os.ErrNotExist)
+	}
+	return h.readLocked(h.index[i])
+}
+
+// readLocked reads the stored event e. The caller must hold h.mutex.
+func (h *History) readLocked(e historyIndexEntry) ([]byte, error) {
+	buf := make([]byte, e.length)
+	if _, err := h.file.ReadAt(buf, e.offset); err != nil {
+		return nil, fmt.Errorf("reading history entry %d: %w", e.id, err)
+	}
+	return buf, nil
+}
+
+// Close records the last id handed out by Stamp, then flushes and closes
+// the log file. After a crash, ids given to events since the last logged
+// one may be handed out again.
+func (h *History) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.lastID > h.loggedID {
+		line := fmt.Sprintf("{\"id\":%d,\"time\":%q}\n", h.lastID, time.Now().UTC().Format(time.RFC3339Nano))
+		if _, err := h.file.WriteAt([]byte(line), h.size); err != nil {
+			log.Printf("[WARN] Failed to record the last history id: %v", err)
+		}
+	}
+	if err := h.file.Sync(); err != nil {
+		h.file.Close()
+		return err
+	}
+	return h.file.Close()
+}
+
+// sendHistory sends one page of a channel's history to c.
+func (m *MessageServer) sendHistory(c *Client, channel string, q HistoryQuery) {
+	events, more, err := m.history.Page(q)
+	if err != nil {
+		log.Printf("[%s] Failed to read history of #%s: %v", c.Name, channel, err)
+		m.sendError(c, "history", errors.New("history is unavailable"))
+		return
+	}
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":      "history",
+		"channel":   channel,
+		"messages":  events,
+		"has_more":  more,
+		"before_id": q.BeforeID,
+	})
+	m.SendMessage(c, msg)
+}
+
+// sendBackfill sends the latest HistoryBacklog events of channel to c.
+func (m *MessageServer) sendBackfill(c *Client, channel string) {
+	if m.config.HistoryBacklog == 0 {
+		return
+	}
+	m.sendHistory(c, channel, HistoryQuery{Channel: channel, Limit: m.config.HistoryBacklog})
+}
+
+// handleHistoryRequest serves {"type":"history","channel","before_id","before","limit"}.
+func handleHistoryRequest(server *MessageServer, client *Client, msg map[string]interface{}) {
+	raw, _ := msg["channel"].(string)
+	channel, err := resolveChannel(server, client, raw)
+	if err != nil {
+		server.sendError(client, "history", err)
+		return
+	}
+
+	q := HistoryQuery{Channel: channel, Limit: server.config.HistoryBacklog}
+	if id, ok := msg["before_id"].(float64); ok && id > 0 {
+		q.BeforeID = int64(id)
+	}
+	if s, ok := msg["before"].(string); ok && s != "" {
+		if q.Before, err = time.Parse(time.RFC3339, s); err != nil {
+			server.sendError(client, "history", errors.New(`"before" must be an RFC3339 timestamp`))
+			return
+		}
+	}
+	if n, ok := msg["limit"].(float64); ok && n > 0 {
+		q.Limit = int(n)
+	}
+	if q.Limit <= 0 || q.Limit > maxHistoryPage {
+		q.Limit = maxHistoryPage
+	}
+	server.sendHistory(client, channel, q)
+}
+
+// handleDrawingDataRequest serves {"type":"drawing_data","channel","id"}
+// with the image of a drawing that a history page returned without it:
+// {"type":"drawing_data","channel","id","data"}. Like live drawings it goes
+// to the bulk lane.
+func handleDrawingDataRequest(server *MessageServer, client *Client, msg map[string]interface{}) {
+	raw, _ := msg["channel"].(string)
+	channel, err := resolveChannel(server, client, raw)
+	if err != nil {
+		server.sendError(client, "drawing_data", err)
+		return
+	}
+	id, _ := msg["id"].(float64)
+	if id < 1 || id > 1<<53 { // also keeps the conversion to int64 exact
+		server.sendError(client, "drawing_data", errors.New(`"id" must be a positive event id`))
+		return
+	}
+
+	event, err := server.history.Event(channel, int64(id))
+	var drawing struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	}
+	if err == nil {
+		err = json.Unmarshal(event, &drawing)
+	}
+	if err == nil && drawing.Type != "drawing" {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		log.Printf("[%s] Cannot read drawing %d of #%s: %v", client.Name, int64(id), channel, err)
+		server.sendError(client, "drawing_data", errors.New("drawing not found"))
+		return
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":    "drawing_data",
+		"channel": channel,
+		"id":      int64(id),
+		"data":    drawing.Data,
+	})
+	server.sendQueued(client, outboundMessage{data: data, bulk: true})
+}
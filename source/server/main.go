@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
@@ -15,20 +22,64 @@ func main() {
 	// Use all available CPU cores
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	if err := os.MkdirAll("uploads", 0o755); err != nil {
-		log.Fatalf("Failed to create 'uploads' directory: %v", err)
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	if err := os.MkdirAll(cfg.UploadDir, 0o755); err != nil {
+		log.Fatalf("Failed to create upload directory %q: %v", cfg.UploadDir, err)
+	}
+	if n := removeStalePartFiles(cfg.UploadDir); n > 0 {
+		log.Printf("Removed %d unfinished upload parts from a previous run", n)
+	}
+
+	// Stop on SIGINT/SIGTERM; a second signal kills the process immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	history, err := OpenHistory(cfg.HistoryFile)
+	if err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+
+	storage, err := OpenStorage(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	uploads, err := OpenUploadRegistry(cfg.UploadDir, time.Duration(cfg.UploadTTL), storage)
+	if err != nil {
+		log.Fatalf("Failed to open upload sessions: %v", err)
 	}
 
 	// Initialize the central message server
-	messageServer := NewMessageServer()
+	messageServer := NewMessageServer(cfg, history, uploads, storage, OpenBlobStore(storage))
+	files, err := messageServer.LoadFiles()
+	if err != nil {
+		log.Fatalf("Failed to load shared files: %v", err)
+	}
+
+	authenticator, err := NewAuthenticator(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+
+	originPolicy, err := NewOriginPolicy(cfg.AllowedOrigins, cfg.AllowAnyOrigin)
+	if err != nil {
+		log.Fatalf("Invalid origin allow-list: %v", err)
+	}
 
 	// Configure the WebTransport server
 	wt := webtransport.Server{
 		H3: http3.Server{
-			Addr: ":4433",
+			Addr: cfg.ListenAddr,
 		},
 		CheckOrigin: func(r *http.Request) bool {
-			return true
+			return originPolicy.Check(r) == nil
 		},
 	}
 
@@ -37,6 +88,26 @@ func main() {
 
 	// Define the HTTP handler for the /chat endpoint
 	http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		if messageServer.IsShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// Check the origin here rather than in Upgrade so the client gets a 403
+		if err := originPolicy.Check(r); err != nil {
+			log.Printf("Rejected session from %s: %v", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			log.Printf("Authentication failed from %s: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
 		session, err := wt.Upgrade(w, r)
 		if err != nil {
 			log.Printf("Upgrading to WebTransport failed: %s", err)
@@ -45,17 +116,77 @@ func main() {
 		}
 
 		sessionID := atomic.AddInt32(&sessionIDCounter, 1)
-		go handleWebTransportSession(messageServer, int(sessionID), session, r)
+		go handleWebTransportSession(messageServer, int(sessionID), session, principal)
 	})
 
-	log.Println("Starting WebTransport chat server on :4433 ...")
-	log.Println("File uploads will be saved to ./uploads/")
-	log.Printf("Multi-stream mode: %d concurrent streams", NUM_STREAMS)
-	log.Printf("Chunk size: %d MB", CHUNK_SIZE/(1024*1024))
+	log.Printf("Starting WebTransport chat server on %s ...", cfg.ListenAddr)
+	if cfg.Storage == storageS3 {
+		log.Printf("Shared files will be stored in S3 bucket %s at %s, uploads staged in %s", cfg.S3Bucket, cfg.S3Endpoint, cfg.UploadDir)
+	} else {
+		log.Printf("File uploads will be saved to %s", cfg.UploadDir)
+	}
+	log.Printf("Multi-stream mode: %d concurrent streams", cfg.NumStreams)
+	log.Printf("Chunk size: %s, max file size: %s", cfg.ChunkSize, cfg.MaxFileSize)
+	log.Printf("Unfinished uploads: %d, expiring after %s idle", uploads.Len(), cfg.UploadTTL)
+	log.Printf("Shared files: %d", files)
+	log.Printf("Authentication mode: %s", cfg.AuthMode)
+	log.Printf("History: %s (%d events replayed on join)", cfg.HistoryFile, cfg.HistoryBacklog)
+	if cfg.AllowAnyOrigin {
+		log.Println("[WARN] Accepting sessions from any origin (development mode)")
+	} else if len(cfg.AllowedOrigins) > 0 {
+		log.Printf("Allowed origins: %s", cfg.AllowedOrigins)
+	} else {
+		log.Println("No origin allow-list configured, accepting same-origin sessions only")
+	}
+
+	var hashServer *http.Server
+	serveErr := make(chan error, 1)
+	if cfg.DevTLS {
+		// Serve with a generated certificate that browsers accept through
+		// serverCertificateHashes, without mkcert or developer flags.
+		certs, err := newDevCertManager(devCertHosts(cfg.ListenAddr))
+		if err != nil {
+			log.Fatalf("Failed to generate dev certificate: %v", err)
+		}
+		go certs.Run(ctx)
+
+		hashMux := http.NewServeMux()
+		hashMux.Handle("/cert-hash", certs)
+		hashServer = &http.Server{Addr: cfg.DevCertAddr, Handler: hashMux}
+		go func() {
+			if err := hashServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Dev certificate hash endpoint failed: %v", err)
+			}
+		}()
+		log.Printf("Dev TLS enabled, certificate hash served at http://%s/cert-hash", cfg.DevCertAddr)
 
-	// Start the server (requires certificate and key files)
-	err := wt.ListenAndServeTLS("26.135.88.251.pem", "26.135.88.251-key.pem")
-	if err != nil {
-		log.Fatalf("ListenAndServeTLS failed: %v", err)
+		wt.H3.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		go func() { serveErr <- wt.ListenAndServe() }()
+	} else {
+		// Start the server (requires certificate and key files)
+		go func() { serveErr <- wt.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile) }()
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("WebTransport server failed: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutdown signal received, draining sessions (grace period %s) ...", cfg.ShutdownGrace)
+	messageServer.Shutdown(time.Duration(cfg.ShutdownGrace))
+
+	if err := wt.Close(); err != nil {
+		log.Printf("Error closing WebTransport server: %v", err)
+	}
+	if hashServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		hashServer.Shutdown(shutdownCtx)
+		cancel()
+	}
+	if err := history.Close(); err != nil {
+		log.Printf("Error closing history: %v", err)
 	}
+	log.Println("Server stopped")
 }
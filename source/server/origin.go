@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern is one entry of the origin allow-list, such as
+// "https://chat.example.com", "http://localhost:5500" or
+// "https://*.example.com" (any subdomain, but not the bare domain).
+type originPattern struct {
+	scheme   string
+	host     string // without the "*." prefix for wildcard patterns
+	port     string // empty means the scheme's default port
+	wildcard bool
+}
+
+// parseOriginPattern validates and parses an allow-list entry.
+func parseOriginPattern(s string) (originPattern, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return originPattern{}, fmt.Errorf("invalid origin %q: expected scheme://host[:port]", s)
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.User != nil {
+		return originPattern{}, fmt.Errorf("invalid origin %q: must not contain a path, query or credentials", s)
+	}
+
+	p := originPattern{scheme: strings.ToLower(u.Scheme), port: u.Port()}
+	host := strings.ToLower(u.Hostname())
+	if strings.HasPrefix(host, "*.") {
+		p.wildcard = true
+		host = strings.TrimPrefix(host, "*.")
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return originPattern{}, fmt.Errorf("invalid origin %q: only a leading \"*.\" wildcard is supported", s)
+	}
+	p.host = host
+	return p, nil
+}
+
+// matches reports whether the parsed Origin header satisfies the pattern.
+func (p originPattern) matches(origin *url.URL) bool {
+	if strings.ToLower(origin.Scheme) != p.scheme || origin.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(origin.Hostname())
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// OriginPolicy decides which web origins may open a WebTransport session.
+type OriginPolicy struct {
+	patterns []originPattern
+	allowAll bool
+}
+
+// NewOriginPolicy builds the policy from the configured allow-list. With
+// allowAll set every origin is accepted, which is only meant for development.
+func NewOriginPolicy(allowed []string, allowAll bool) (*OriginPolicy, error) {
+	p := &OriginPolicy{allowAll: allowAll}
+	for _, s := range allowed {
+		pattern, err := parseOriginPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p, nil
+}
+
+// Check returns nil if the request's origin is allowed, or an error that
+// explains why it was rejected.
+//
+// Requests without an Origin header come from non-browser clients, which
+// cannot be abused for cross-site requests, and are always accepted. When
+// the allow-list is empty only same-origin requests are accepted.
+func (p *OriginPolicy) Check(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.allowAll {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("malformed origin %q", origin)
+	}
+
+	if len(p.patterns) == 0 {
+		if strings.EqualFold(u.Host, r.Host) {
+			return nil
+		}
+		return fmt.Errorf("origin %q does not match host %q and no allow-list is configured", origin, r.Host)
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.matches(u) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q is not in the allow-list", origin)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outbound queue policies, applied when a client's queue is full.
+const (
+	// policyBlock gives the client up to OutboundTimeout to catch up, then
+	// drops the new message. Producers never wait: the message is queued
+	// past the capacity with a deadline, and the send loop discards it if
+	// the queue has not drained below the capacity by then. At most
+	// blockOverflow times the capacity may be queued; beyond that new
+	// messages are dropped at once.
+	policyBlock = "block"
+	// policyDropOldest discards the oldest queued message of the same lane.
+	policyDropOldest = "drop-oldest"
+	// policyCoalesce replaces queued state snapshots (channel list, online
+	// list, ...) with newer ones and otherwise drops the oldest message.
+	policyCoalesce = "coalesce"
+	// policyDisconnect closes the session of a client that cannot keep up.
+	policyDisconnect = "disconnect"
+)
+
+// outboundPolicies lists the valid values of Config.OutboundPolicy.
+var outboundPolicies = []string{policyBlock, policyDropOldest, policyCoalesce, policyDisconnect}
+
+// blockOverflow bounds how far policyBlock lets a lane grow past its
+// capacity, as a multiple of the capacity, so that a stalled client cannot
+// make the server buffer an unbounded amount of data.
+const blockOverflow = 2
+
+// bulkQueueSize is how many bulky messages (drawings) may wait per client.
+// They sit in their own lane, which is only drained while no chat or
+// control message is waiting, so a burst of drawings never delays chat.
+const bulkQueueSize = 8
+
+// outboundMessage is one encoded event waiting to be written to a client.
+type outboundMessage struct {
+	data []byte
+	key  string // state snapshots with the same key supersede each other
+	bulk bool
+
+	// deadline is set on a message queued past the capacity under
+	// policyBlock, and cleared once the queue has room for it.
+	deadline time.Time
+}
+
+// outboundStats counts what the queues had to discard, server-wide.
+type outboundStats struct {
+	dropped      atomic.Int64
+	coalesced    atomic.Int64
+	disconnected atomic.Int64
+}
+
+// outboundQueue is the per-client queue between producers (broadcasts,
+// replies) and the client's send loop.
+type outboundQueue struct {
+	owner string // client name, for logging
+
+	mutex  sync.Mutex
+	normal []outboundMessage
+	bulk   []outboundMessage
+	closed bool
+
+	capacity int
+	policy   string
+	timeout  time.Duration
+
+	ready      chan struct{} // signalled when a message is queued
+	done       chan struct{} // closed when the queue is closed
+	onOverflow func()        // called once when the disconnect policy trips
+
+	dropped   atomic.Int64
+	coalesced atomic.Int64
+	totals    *outboundStats
+}
+
+func newOutboundQueue(owner string, cfg *Config, totals *outboundStats, onOverflow func()) *outboundQueue {
+	return &outboundQueue{
+		owner:      owner,
+		capacity:   cfg.ClientChannelSize,
+		policy:     cfg.OutboundPolicy,
+		timeout:    time.Duration(cfg.OutboundTimeout),
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		onOverflow: onOverflow,
+		totals:     totals,
+	}
+}
+
+// push queues msg according to the queue's policy. It never blocks, so it
+// may be called while holding locks shared with other clients.
+func (q *outboundQueue) push(msg outboundMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+
+	lane, limit := &q.normal, q.capacity
+	if msg.bulk {
+		lane, limit = &q.bulk, bulkQueueSize
+	}
+
+	if q.policy == policyCoalesce && msg.key != "" {
+		for i, queued := range *lane {
+			if queued.key == msg.key {
+				// Drop the stale snapshot; the new one goes to the back so it
+				// still follows the events that preceded it
+				*lane = append((*lane)[:i], (*lane)[i+1:]...)
+				q.coalesced.Add(1)
+				q.totals.coalesced.Add(1)
+				break
+			}
+		}
+	}
+
+	if len(*lane) >= limit {
+		switch q.policy {
+		case policyBlock:
+			q.expireLocked(lane, limit, time.Now())
+			if len(*lane) >= blockOverflow*limit {
+				q.countDrop("dropped the new message")
+				return
+			}
+			if len(*lane) >= limit {
+				msg.deadline = time.Now().Add(q.timeout)
+			}
+		case policyDropOldest, policyCoalesce:
+			(*lane)[0] = outboundMessage{}
+			*lane = (*lane)[1:]
+			q.countDrop("dropped the oldest message")
+		case policyDisconnect:
+			q.closeLocked()
+			q.totals.disconnected.Add(1)
+			go q.onOverflow()
+			return
+		}
+	}
+
+	*lane = append(*lane, msg)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// expireLocked applies policyBlock to lane: messages queued past limit
+// whose deadline has passed are dropped, and those the lane now has room
+// for are kept for good. Waiting messages were queued in order, so their
+// deadlines are too. The caller must hold q.mutex.
+func (q *outboundQueue) expireLocked(lane *[]outboundMessage, limit int, now time.Time) {
+	msgs := *lane
+	first := len(msgs)
+	for i, msg := range msgs {
+		if !msg.deadline.IsZero() {
+			first = i
+			break
+		}
+	}
+	expired := 0
+	for first+expired < len(msgs) && now.After(msgs[first+expired].deadline) {
+		q.countDrop("timed out waiting for the client")
+		expired++
+	}
+	if expired > 0 {
+		msgs = append(msgs[:first], msgs[first+expired:]...)
+		clear(msgs[len(msgs) : len(msgs)+expired])
+		*lane = msgs
+	}
+	for i := first; i < len(msgs) && i < limit; i++ {
+		msgs[i].deadline = time.Time{}
+	}
+}
+
+// countDrop records a discarded message. The caller must hold q.mutex.
+func (q *outboundQueue) countDrop(reason string) {
+	n := q.dropped.Add(1)
+	q.totals.dropped.Add(1)
+	log.Printf("[WARN] Outbound queue full for client %s (%s policy), %s; %d messages lost so far", q.owner, q.policy, reason, n)
+}
+
+// pop returns the next message to send, preferring the normal lane.
+func (q *outboundQueue) pop() ([]byte, bool) {
+	q.mutex.Lock()
+	var msg outboundMessage
+	switch {
+	case len(q.normal) > 0:
+		msg = q.normal[0]
+		q.normal[0] = outboundMessage{}
+		q.normal = q.normal[1:]
+	case len(q.bulk) > 0:
+		msg = q.bulk[0]
+		q.bulk[0] = outboundMessage{}
+		q.bulk = q.bulk[1:]
+	default:
+		q.mutex.Unlock()
+		return nil, false
+	}
+	if q.policy == policyBlock {
+		// Taking a message made room for one that may still be waiting
+		now := time.Now()
+		q.expireLocked(&q.normal, q.capacity, now)
+		q.expireLocked(&q.bulk, bulkQueueSize, now)
+	}
+	q.mutex.Unlock()
+	return msg.data, true
+}
+
+// len returns the number of queued messages.
+func (q *outboundQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.normal) + len(q.bulk)
+}
+
+// close discards everything still queued and rejects further pushes.
+func (q *outboundQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closeLocked()
+}
+
+func (q *outboundQueue) closeLocked() {
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.normal, q.bulk = nil, nil
+	close(q.done)
+}
+
+// delivery is one message and the clients it is queued for.
+type delivery struct {
+	targets []*Client
+	msg     outboundMessage
+}
+
+// deliverAndUnlock queues msg for every target in order. It must be called
+// with m.mutex held and releases it: the fan-out lock is taken first, so
+// messages reach every queue in the order they were stamped, while the
+// fan-out to many clients does not hold up unrelated work on m.mutex. No
+// push blocks, so a slow client never delays the others.
+func (m *MessageServer) deliverAndUnlock(targets []*Client, msg outboundMessage) {
+	m.deliverBatchAndUnlock([]delivery{{targets, msg}})
+}
+
+// deliverBatchAndUnlock is deliverAndUnlock for several messages.
+func (m *MessageServer) deliverBatchAndUnlock(deliveries []delivery) {
+	m.fanout.Lock()
+	m.mutex.Unlock()
+	defer m.fanout.Unlock()
+	for _, d := range deliveries {
+		for _, c := range d.targets {
+			c.queue.push(d.msg)
+		}
+	}
+}
+
+// handleStatsRequest sends the outbound queue counters to an admin.
+func handleStatsRequest(server *MessageServer, client *Client) {
+	if !client.Principal.IsAdmin() {
+		server.sendError(client, "stats", errors.New("only admins can view server statistics"))
+		return
+	}
+
+	server.mutex.Lock()
+	clients := make([]map[string]interface{}, 0, len(server.listeners))
+	for _, c := range server.listeners {
+		clients = append(clients, map[string]interface{}{
+			"id":        c.ID,
+			"name":      c.Name,
+			"queued":    c.queue.len(),
+			"dropped":   c.queue.dropped.Load(),
+			"coalesced": c.queue.coalesced.Load(),
+		})
+	}
+	server.mutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i]["id"].(int) < clients[j]["id"].(int) })
+
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":   "stats",
+		"policy": server.config.OutboundPolicy,
+		"outbound": map[string]int64{
+			"dropped":      server.outbound.dropped.Load(),
+			"coalesced":    server.outbound.coalesced.Load(),
+			"disconnected": server.outbound.disconnected.Load(),
+		},
+		"clients": clients,
+	})
+	server.SendMessage(client, msg)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Presence states a client can report.
+const (
+	presenceOnline = "online"
+	presenceAway   = "away"
+	presenceBusy   = "busy"
+)
+
+var presenceStates = map[string]bool{presenceOnline: true, presenceAway: true, presenceBusy: true}
+
+// maxStatusText limits the custom status text, in characters.
+const maxStatusText = 100
+
+// maxLastSeen limits how many departed members an online list reports.
+const maxLastSeen = 50
+
+// typingTTL is how long a typing indicator lasts unless the client renews
+// it with another start. Clients renew every few seconds while typing, so
+// a crashed client stops "typing" at most typingTTL later.
+const typingTTL = 6 * time.Second
+
+// typingKey identifies one client typing in one channel.
+type typingKey struct {
+	clientID int
+	channel  string
+}
+
+// onlineListLocked builds the online list of channel: its connected
+// members with their presence, and the members that left with the time they
+// were last seen. online holds the subjects with a connected session. The
+// caller must hold m.mutex.
+func (m *MessageServer) onlineListLocked(channel string, members []*Client, online map[string]bool) map[string]interface{} {
+	clients := make([]map[string]interface{}, 0, len(members))
+	for _, c := range members {
+		entry := map[string]interface{}{"id": c.ID, "name": c.Name, "presence": c.Presence}
+		if c.StatusText != "" {
+			entry["status"] = c.StatusText
+		}
+		clients = append(clients, entry)
+	}
+
+	type departed struct {
+		name     string
+		lastSeen time.Time
+	}
+	var gone []departed
+	for subject, ms := range m.memberships {
+		if !online[subject] && ms.channels[channel] && ms.name != "" {
+			gone = append(gone, departed{ms.name, ms.lastSeen})
+		}
+	}
+	sort.Slice(gone, func(i, j int) bool { return gone[i].lastSeen.After(gone[j].lastSeen) })
+	if len(gone) > maxLastSeen {
+		gone = gone[:maxLastSeen]
+	}
+	offline := make([]map[string]interface{}, 0, len(gone))
+	for _, d := range gone {
+		offline = append(offline, map[string]interface{}{
+			"name":      d.name,
+			"last_seen": d.lastSeen.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return map[string]interface{}{
+		"type":    "online",
+		"channel": channel,
+		"clients": clients,
+		"offline": offline,
+	}
+}
+
+// SetPresence changes the presence state and status text of c.
+func (m *MessageServer) SetPresence(c *Client, state, status string) {
+	m.mutex.Lock()
+	c.Presence = state
+	c.StatusText = status
+	m.mutex.Unlock()
+	log.Printf("[%s] Presence set to %s %q", c.Name, state, status)
+}
+
+// handlePresenceRequest processes {"type":"presence","state","status"}.
+// An omitted state keeps the current one; the status text is replaced.
+func handlePresenceRequest(server *MessageServer, client *Client, msg map[string]interface{}) {
+	server.mutex.Lock()
+	state := client.Presence
+	server.mutex.Unlock()
+
+	if raw, ok := msg["state"]; ok {
+		s, _ := raw.(string)
+		if !presenceStates[s] {
+			server.sendError(client, "presence", errors.New("state must be online, away or busy"))
+			return
+		}
+		state = s
+	}
+	status, _ := msg["status"].(string)
+	status = strings.TrimSpace(status)
+	if utf8.RuneCountInString(status) > maxStatusText {
+		server.sendError(client, "presence", fmt.Errorf("status text too long (max %d characters)", maxStatusText))
+		return
+	}
+
+	server.SetPresence(client, state, status)
+	server.BroadcastOnlineList()
+}
+
+// SetTyping starts or stops the typing indicator of c in channel and relays
+// the change to the other members. A start that is not renewed within
+// typingTTL expires as if the client had sent a stop.
+func (m *MessageServer) SetTyping(c *Client, channel string, typing bool) {
+	m.mutex.Lock()
+	key := typingKey{c.ID, channel}
+	if t, ok := m.typing[key]; ok {
+		t.Stop()
+		delete(m.typing, key)
+	} else if !typing {
+		m.mutex.Unlock()
+		return
+	}
+	if typing {
+		var t *time.Timer
+		// The callback takes m.mutex, so t is assigned before it can run
+		t = time.AfterFunc(typingTTL, func() { m.expireTyping(key, t) })
+		m.typing[key] = t
+	}
+	targets := m.typingTargetsLocked(c, channel)
+	m.mutex.Unlock()
+
+	sendTyping(targets, c, channel, typing)
+}
+
+// StopAllTyping clears every typing indicator of c, e.g. when it leaves.
+func (m *MessageServer) StopAllTyping(c *Client) {
+	for _, channel := range m.ClientChannels(c) {
+		m.SetTyping(c, channel, false)
+	}
+}
+
+// expireTyping ends a typing indicator whose timer fired, unless it was
+// renewed or stopped in the meantime.
+func (m *MessageServer) expireTyping(key typingKey, t *time.Timer) {
+	m.mutex.Lock()
+	if m.typing[key] != t {
+		m.mutex.Unlock()
+		return
+	}
+	delete(m.typing, key)
+	c, ok := m.listeners[key.clientID]
+	if !ok {
+		m.mutex.Unlock()
+		return
+	}
+	targets := m.typingTargetsLocked(c, key.channel)
+	m.mutex.Unlock()
+
+	sendTyping(targets, c, key.channel, false)
+}
+
+// typingTargetsLocked returns the members of channel other than c that
+// negotiated the typing feature. The caller must hold m.mutex.
+func (m *MessageServer) typingTargetsLocked(c *Client, channel string) []*Client {
+	var targets []*Client
+	for _, member := range m.channelMembersLocked(channel) {
+		if member.ID != c.ID && member.Features["typing"] {
+			targets = append(targets, member)
+		}
+	}
+	return targets
+}
+
+// sendTyping relays a typing change as a datagram. Typing indicators are
+// lossy by nature: a lost start is repeated by the next renewal and a lost
+// stop is covered by the expires_in deadline on the receiving side.
+func sendTyping(targets []*Client, c *Client, channel string, typing bool) {
+	if len(targets) == 0 {
+		return
+	}
+	state := "stop"
+	if typing {
+		state = "start"
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type":       "typing",
+		"channel":    channel,
+		"state":      state,
+		"user":       map[string]interface{}{"id": c.ID, "name": c.Name},
+		"expires_in": typingTTL.Milliseconds(),
+	})
+	if err != nil {
+		log.Printf("Error marshaling typing event: %v", err)
+		return
+	}
+	for _, t := range targets {
+		if err := t.Session.SendDatagram(data); err != nil {
+			log.Printf("[%s] Failed to send typing datagram: %v", t.Name, err)
+		}
+	}
+}
+
+// handleTyping processes {"type":"typing","channel","state":"start"|"stop"}.
+// It arrives as a datagram, so invalid input is logged rather than answered.
+func handleTyping(server *MessageServer, client *Client, msg map[string]interface{}) {
+	requested, _ := msg["channel"].(string)
+	channel, err := resolveChannel(server, client, requested)
+	if err != nil {
+		log.Printf("[%s] Ignoring typing event: %v", client.Name, err)
+		return
+	}
+	switch state, _ := msg["state"].(string); state {
+	case "start":
+		server.SetTyping(client, channel, true)
+	case "stop":
+		server.SetTyping(client, channel, false)
+	default:
+		log.Printf("[%s] Ignoring typing event with state %q", client.Name, state)
+	}
+}
+
+// handleDatagram dispatches a datagram received from a client.
+func handleDatagram(server *MessageServer, client *Client, data []byte) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[%s] Invalid datagram: %v", client.Name, err)
+		return
+	}
+	switch msgType, _ := msg["type"].(string); msgType {
+	case "typing":
+		handleTyping(server, client, msg)
+	default:
+		log.Printf("[%s] Unknown datagram type %q", client.Name, msgType)
+	}
+}
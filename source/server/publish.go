@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Conflict policies applied when a merged upload is published under a name
+// that is already taken.
+const (
+	conflictReject  = "reject"  // fail the merge
+	conflictRename  = "rename"  // publish as "report (1).pdf", "report (2).pdf", ...
+	conflictVersion = "version" // keep the existing file as an older version
+)
+
+var conflictPolicies = []string{conflictReject, conflictRename, conflictVersion}
+
+var errFileExists = errors.New("a file with this name already exists")
+
+// maxRenameAttempts bounds how many numbered names the rename policy tries.
+const maxRenameAttempts = 1000
+
+// publishFile publishes the blob stored for v.SHA256 under name on behalf
+// of client, resolving a name conflict with the configured policy, and
+// records it as a new version described by v. A new version of an existing
+// file is subject to the edit policy, like deleting or renaming it. It
+// returns the name the file was published under and its version. The new
+// version appears when the version index is replaced, so readers see either
+// the previous version or the complete new one.
+func (m *MessageServer) publishFile(client *Client, name string, v fileVersion) (string, fileVersion, error) {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	idx, err := m.fileIndexLocked(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", v, err
+	}
+	if len(idx.Versions) > 0 {
+		switch m.config.UploadConflict {
+		case conflictReject:
+			return "", v, errFileExists
+		case conflictRename:
+			if name, err = m.freeNameLocked(name); err != nil {
+				return "", v, err
+			}
+			idx = versionIndex{}
+		case conflictVersion:
+			if !m.canEdit(client, idx) {
+				return "", v, errEditNotAllowed
+			}
+		}
+	}
+	if len(idx.Versions) == 0 {
+		idx = versionIndex{Owner: v.UploaderID, OwnerName: v.Uploader, Created: v.Time}
+	}
+
+	if err := m.blobs.Ref(v.SHA256); err != nil {
+		return "", v, err
+	}
+
+	v.Version = 1
+	if len(idx.Versions) > 0 {
+		v.Version = idx.Versions[len(idx.Versions)-1].Version + 1
+	}
+	idx.Versions = append(idx.Versions, v)
+	if err := m.updateIndexLocked(name, idx); err != nil {
+		m.blobs.Unref(v.SHA256)
+		return "", v, err
+	}
+	return name, v, nil
+}
+
+// freeNameLocked returns the first of "name (1).ext", "name (2).ext", ...
+// that is not in the catalog. It fails if the first maxRenameAttempts names
+// are all taken. The caller must hold m.publishMutex.
+func (m *MessageServer) freeNameLocked(name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, ok := m.catalog[candidate]; !ok {
+			return candidate, nil
+		}
+	}
+	return "", errFileExists
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxTrackedReceipts bounds how many recent events remember their sender
+// for receipts. Acks for older events, or for events sent before a restart,
+// are ignored.
+const maxTrackedReceipts = 10000
+
+// maxAckBatch is the largest number of ids accepted in one ack.
+const maxAckBatch = 200
+
+// Receipt statuses, in increasing order.
+var receiptRank = map[string]int{"delivered": 1, "read": 2}
+
+// receiptState is what the server remembers about one sent event.
+type receiptState struct {
+	sender     string          // Principal.Subject of the sender
+	channel    string          // empty for direct messages
+	recipients map[string]bool // subjects allowed to ack a direct message
+	status     map[string]int  // highest receipt rank seen per subject
+}
+
+// receiptTracker maps recent event ids to their sender so that delivery
+// and read acks can be fanned out to the sender.
+type receiptTracker struct {
+	mutex  sync.Mutex
+	events map[int64]*receiptState
+	order  []int64 // ids in insertion order, for eviction
+}
+
+func newReceiptTracker() *receiptTracker {
+	return &receiptTracker{events: make(map[int64]*receiptState)}
+}
+
+// track remembers the sender of a stamped event. Events without an id
+// (the history could not record them) are not tracked.
+func (t *receiptTracker) track(event map[string]interface{}, sender, channel string, recipients map[string]bool) {
+	id, ok := event["id"].(int64)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.events[id] = &receiptState{sender: sender, channel: channel, recipients: recipients, status: make(map[string]int)}
+	t.order = append(t.order, id)
+	if len(t.order) > maxTrackedReceipts {
+		delete(t.events, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// record registers that subject reached status for event id. It returns the
+// sender to notify, or ok=false if the ack is unknown, not allowed, comes
+// from the sender itself or does not raise the recorded status.
+func (t *receiptTracker) record(id int64, subject string, rank int, isMember func(channel string) bool) (sender string, ok bool) {
+	t.mutex.Lock()
+	state, found := t.events[id]
+	if !found || state.sender == subject || state.status[subject] >= rank {
+		t.mutex.Unlock()
+		return "", false
+	}
+	channel, recipients := state.channel, state.recipients
+	t.mutex.Unlock()
+
+	// Check membership outside t.mutex; it takes the server mutex
+	if channel != "" && !isMember(channel) || channel == "" && !recipients[subject] {
+		return "", false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if state.status[subject] >= rank {
+		return "", false
+	}
+	state.status[subject] = rank
+	return state.sender, true
+}
+
+// clientsBySubject returns the connected sessions of an identity.
+func (m *MessageServer) clientsBySubject(subject string) []*Client {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var clients []*Client
+	for _, c := range m.listeners {
+		if c.Principal.Subject == subject {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// handleAck processes {"type":"ack","status":"delivered"|"read","ids":[...]}
+// (or a single "id") and sends a receipt event to each sender:
+// {"type":"receipt","status","ids","by":{"id","name"},"time"}.
+func handleAck(server *MessageServer, client *Client, msg map[string]interface{}) {
+	status, _ := msg["status"].(string)
+	rank, ok := receiptRank[status]
+	if !ok {
+		server.sendError(client, "ack", errors.New(`status must be "delivered" or "read"`))
+		return
+	}
+
+	var ids []int64
+	if id, ok := msg["id"].(float64); ok {
+		ids = append(ids, int64(id))
+	}
+	if list, ok := msg["ids"].([]interface{}); ok {
+		for _, v := range list {
+			if id, ok := v.(float64); ok {
+				ids = append(ids, int64(id))
+			}
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxAckBatch {
+		server.sendError(client, "ack", errors.New("ack needs between 1 and 200 message ids"))
+		return
+	}
+
+	isMember := func(channel string) bool { return server.IsMember(client, channel) }
+	bySender := make(map[string][]int64)
+	for _, id := range ids {
+		if sender, ok := server.receipts.record(id, client.Principal.Subject, rank, isMember); ok {
+			bySender[sender] = append(bySender[sender], id)
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	total := 0
+	for sender, acked := range bySender {
+		total += len(acked)
+		receipt, _ := json.Marshal(map[string]interface{}{
+			"type":   "receipt",
+			"status": status,
+			"ids":    acked,
+			"by":     map[string]interface{}{"id": client.ID, "name": client.Name},
+			"time":   now,
+		})
+		for _, c := range server.clientsBySubject(sender) {
+			server.SendMessage(c, receipt)
+		}
+	}
+	if total > 0 {
+		log.Printf("[%s] Acked %d messages as %s", client.Name, total, status)
+	}
+}
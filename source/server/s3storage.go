@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MinCopyPart is the smallest part, other than the last, that S3
+	// accepts in a multipart upload. Compose copies parts server-side when
+	// they are all at least this large and streams them otherwise.
+	s3MinCopyPart = 5 << 20
+
+	// s3UnsignedPayload tells S3 that the request body is not covered by
+	// the signature, so that parts can be streamed from disk.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	s3Timeout = 30 * time.Second
+)
+
+// emptyPayloadHash is the hex SHA-256 of an empty request body.
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// S3Options configures an S3Storage.
+type S3Options struct {
+	Endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region    string
+	Bucket    string
+	Prefix    string // prepended to every key
+	AccessKey string
+	SecretKey string
+
+	// PathStyle addresses the bucket as endpoint/bucket/key instead of
+	// bucket.endpoint/key, as MinIO and most S3-compatible servers expect.
+	PathStyle bool
+
+	// Client sends the requests; nil uses a client with a per-request
+	// response header timeout.
+	Client *http.Client
+}
+
+// S3Storage keeps objects in a bucket of an S3-compatible object store,
+// speaking the S3 REST API with Signature Version 4 authentication.
+type S3Storage struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage returns a Storage keeping its objects in the bucket
+// described by opts. It does not contact the server.
+func NewS3Storage(opts S3Options) (*S3Storage, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q must be an http or https URL", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	client := opts.Client
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = s3Timeout
+		client = &http.Client{Transport: transport}
+	}
+	return &S3Storage{opts: opts, endpoint: endpoint, client: client}, nil
+}
+
+// objectURL returns the URL of key, or of the bucket if key is empty.
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.opts.PathStyle {
+		p += "/" + s.opts.Bucket
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	if key != "" {
+		p += "/" + s.opts.Prefix + key
+	} else if !s.opts.PathStyle {
+		p += "/"
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// copySource names key as the source of a server-side copy.
+func (s *S3Storage) copySource(key string) string {
+	return s3Escape("/"+s.opts.Bucket+"/"+s.opts.Prefix+key, false)
+}
+
+// request sends a signed request for key and returns the response if its
+// status is 2xx. Other responses are turned into errors, a missing object
+// into one matching os.ErrNotExist.
+func (s *S3Storage) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := parseS3Error(resp)
+	var e *s3Error
+	if resp.StatusCode == http.StatusNotFound && (!errors.As(apiErr, &e) || e.Code == "NoSuchKey") {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return nil, fmt.Errorf("S3 %s %s/%s: %w", method, s.opts.Bucket, key, apiErr)
+}
+
+// s3Error is the error document returned by S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+func parseS3Error(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var e s3Error
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return &e
+}
+
+// decodeResult decodes the XML body of a successful response into v. Some
+// operations report failures in a 200 response, so an error document is
+// recognized and returned as an error.
+func decodeResult(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	var e struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		return &e.s3Error
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func (s *S3Storage) PutPart(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := s.request(http.MethodPut, key, nil, nil, f, info.Size(), s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	f.Close()
+	return os.Remove(path)
+}
+
+// Compose copies the parts inside the object store when S3 allows it and
+// otherwise streams them through the server into a single upload.
+func (s *S3Storage) Compose(dst string, parts []string) error {
+	var total int64
+	copyable := len(parts) > 0
+	for i, key := range parts {
+		obj, err := s.Stat(key)
+		if err != nil {
+			return err
+		}
+		total += obj.Size
+		if i < len(parts)-1 && obj.Size < s3MinCopyPart {
+			copyable = false
+		}
+	}
+	if copyable {
+		return s.composeCopy(dst, parts)
+	}
+
+	body := &partsReader{s: s, parts: parts}
+	defer body.Close()
+	resp, err := s.request(http.MethodPut, dst, nil, nil, body, total, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// composeCopy assembles dst with a multipart upload whose parts are copied
+// from the given objects, without the data leaving the object store.
+func (s *S3Storage) composeCopy(dst string, parts []string) error {
+	resp, err := s.request(http.MethodPost, dst, url.Values{"uploads": {""}}, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := decodeResult(resp, &initiated); err != nil {
+		return err
+	}
+	uploadID := initiated.UploadID
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	err = func() error {
+		for i, key := range parts {
+			query := url.Values{"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {uploadID}}
+			header := http.Header{"X-Amz-Copy-Source": {s.copySource(key)}}
+			resp, err := s.request(http.MethodPut, dst, query, header, nil, 0, emptyPayloadHash)
+			if err != nil {
+				return err
+			}
+			var copied struct {
+				ETag string `xml:"ETag"`
+			}
+			if err := decodeResult(resp, &copied); err != nil {
+				return err
+			}
+			complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: copied.ETag})
+		}
+
+		body, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		resp, err := s.request(http.MethodPost, dst, url.Values{"uploadId": {uploadID}}, nil,
+			bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+		if err != nil {
+			return err
+		}
+		var done struct{}
+		return decodeResult(resp, &done)
+	}()
+	if err != nil {
+		if resp, abortErr := s.request(http.MethodDelete, dst, url.Values{"uploadId": {uploadID}}, nil, nil, 0, emptyPayloadHash); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// partsReader reads the given objects one after the other, opening each
+// only when the previous one is exhausted.
+type partsReader struct {
+	s       *S3Storage
+	parts   []string
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			body, err := r.s.OpenRange(r.parts[0], 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.parts = body, r.parts[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+func (s *S3Storage) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	switch {
+	case length == 0:
+		if _, err := s.Stat(key); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.request(http.MethodGet, key, nil, header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(key string) (StorageObject, error) {
+	resp, err := s.request(http.MethodHead, key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3Storage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.opts.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.request(http.MethodGet, "", query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := decodeResult(resp, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			objects = append(objects, StorageObject{
+				Key: strings.TrimPrefix(c.Key, s.opts.Prefix), Size: c.Size, ModTime: c.LastModified,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.request(http.MethodDelete, key, nil, nil, nil, 0, emptyPayloadHash)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host and every x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.opts.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), day)
+	for _, part := range []string{s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query the way Signature Version 4 expects: sorted
+// by name, with every reserved character percent-encoded.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes every byte of s except unreserved characters
+// and, unless encodeSlash is set, slashes.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible server holding one
+// bucket. It checks the Signature Version 4 signature of every request and
+// implements what S3Storage uses: PUT, GET with Range, HEAD and DELETE of
+// objects, ListObjectsV2 with continuation, and multipart uploads whose
+// parts are copied from other objects.
+type fakeS3 struct {
+	t                 *testing.T
+	bucket, region    string
+	accessKey, secret string
+	pageSize          int // keys per ListObjectsV2 page
+
+	mu         sync.Mutex
+	objects    map[string]fakeObject
+	uploads    map[string]map[int][]byte
+	nextUpload int
+	calls      map[string]int // requests served, by operation
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:         t,
+		bucket:    "bucket",
+		region:    "test-region",
+		accessKey: "ACCESS",
+		secret:    "SECRET",
+		pageSize:  2,
+		objects:   make(map[string]fakeObject),
+		uploads:   make(map[string]map[int][]byte),
+		calls:     make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// storage returns an S3Storage using f through srv.
+func (f *fakeS3) storage(t *testing.T, srv *httptest.Server, secret string) *S3Storage {
+	s, err := NewS3Storage(S3Options{
+		Endpoint:  srv.URL,
+		Region:    f.region,
+		Bucket:    f.bucket,
+		Prefix:    "chat/",
+		AccessKey: f.accessKey,
+		SecretKey: secret,
+		PathStyle: true,
+		Client:    srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// verify recomputes the signature of r independently of S3Storage.sign.
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != f.accessKey || credential[2] != f.region {
+		return fmt.Errorf("bad credential %q", fields["Credential"])
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if sum := sha256.Sum256(body); payloadHash != s3UnsignedPayload && payloadHash != hex.EncodeToString(sum[:]) {
+		return errors.New("payload hash does not match the body")
+	}
+
+	query := r.URL.Query()
+	var names []string
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, k := range names {
+		for _, v := range query[k] {
+			pairs = append(pairs, url.QueryEscape(k)+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	var headers strings.Builder
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	if !strings.Contains(fields["SignedHeaders"], "x-amz-date") || !strings.Contains(fields["SignedHeaders"], "host") {
+		return fmt.Errorf("host or date not signed: %s", fields["SignedHeaders"])
+	}
+	path := (&url.URL{Path: r.URL.Path}).EscapedPath()
+	path = strings.NewReplacer("+", "%2B", "@", "%40", ":", "%3A", "=", "%3D", "&", "%26", "$", "%24", ",", "%2C", ";", "%3B").Replace(path)
+	canonical := strings.Join([]string{r.Method, path, strings.Join(pairs, "&"), headers.String(), fields["SignedHeaders"], payloadHash}, "\n")
+
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + strings.Join(credential[1:], "/") + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + f.secret)
+	for _, part := range credential[1:] {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if hex.EncodeToString(mac.Sum(nil)) != fields["Signature"] {
+		return fmt.Errorf("signature mismatch for canonical request\n%s", canonical)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.fail(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		f.t.Logf("%s %s: %v", r.Method, r.URL, err)
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.calls["ListObjectsV2"]++
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.calls["CreateMultipartUpload"]++
+		f.nextUpload++
+		id := strconv.Itoa(f.nextUpload)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.calls["UploadPartCopy"]++
+		upload, ok := f.uploads[query.Get("uploadId")]
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src, found := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+		if !ok || !found {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		upload[n] = src.data
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"etag-%d"</ETag></CopyPartResult>`, n)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.calls["CompleteMultipartUpload"]++
+		f.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.calls["AbortMultipartUpload"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.calls["PutObject"]++
+		if int64(len(body)) != r.ContentLength {
+			f.fail(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = fakeObject{data: body, modTime: time.Now()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.calls[r.Method+"Object"]++
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		f.calls["DeleteObject"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, query.Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		f.calls["ListObjectsV2 continued"]++
+		start, _ = strconv.Atoi(token)
+	}
+	end := min(start+f.pageSize, len(keys))
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, k := range keys[start:end] {
+		var escaped strings.Builder
+		xml.EscapeText(&escaped, []byte(k))
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			escaped.String(), len(f.objects[k].data), f.objects[k].modTime.UTC().Format(time.RFC3339))
+	}
+	if end < len(keys) {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, uploadID string, body []byte) {
+	upload, ok := f.uploads[uploadID]
+	var parts struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if !ok || xml.Unmarshal(body, &parts) != nil || len(parts.Parts) == 0 {
+		f.fail(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data []byte
+	for i, part := range parts.Parts {
+		if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, i+1) {
+			f.fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(parts.Parts)-1 && len(upload[part.PartNumber]) < s3MinCopyPart {
+			// Reported in a 200 response, as S3 does
+			fmt.Fprint(w, "<Error><Code>EntityTooSmall</Code></Error>")
+			return
+		}
+		data = append(data, upload[part.PartNumber]...)
+	}
+	delete(f.uploads, uploadID)
+	f.objects[key] = fakeObject{data: data, modTime: time.Now()}
+	fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := f.objects[key]
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound) // HEAD responses have no body
+			return
+		}
+		f.fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data, status := obj.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		first, last, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+		start, err := strconv.Atoi(first)
+		end := len(data) - 1
+		if last != "" {
+			end, _ = strconv.Atoi(last)
+		}
+		if err != nil || start >= len(data) {
+			f.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		data, status = data[start:min(end, len(data)-1)+1], http.StatusPartialContent
+	}
+	w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	f, srv := newFakeS3(t)
+	testStorage(t, f.storage(t, srv, f.secret), t.TempDir())
+
+	for _, op := range []string{"ListObjectsV2 continued", "UploadPartCopy", "CompleteMultipartUpload", "HEADObject", "DeleteObject"} {
+		if f.count(op) == 0 {
+			t.Errorf("no %s request was made", op)
+		}
+	}
+	// Every key was stored under the prefix
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.objects {
+		if !strings.HasPrefix(key, "chat/") {
+			t.Errorf("object %q stored outside the prefix", key)
+		}
+	}
+}
+
+func TestS3StorageComposeCopy(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := f.storage(t, srv, f.secret)
+	scratch := t.TempDir()
+	parts := []string{"p/0", "p/1", "p/2"}
+	for i, n := range []int{s3MinCopyPart, s3MinCopyPart, 1} {
+		if err := putBytes(s, scratch, parts[i], make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	puts := f.count("PutObject")
+	if err := s.Compose("composed", parts); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("UploadPartCopy"); got != len(parts) {
+		t.Errorf("%d parts copied, want %d", got, len(parts))
+	}
+	if f.count("PutObject") != puts {
+		t.Error("large parts were streamed instead of copied")
+	}
+
+	// A failed copy aborts the multipart upload
+	f.mu.Lock()
+	f.objects["chat/p/1"] = fakeObject{data: make([]byte, 10), modTime: time.Now()}
+	f.mu.Unlock()
+	if err := s.composeCopy("small", parts); err == nil || !strings.Contains(err.Error(), "EntityTooSmall") {
+		t.Errorf("composeCopy of a small middle part: got %v, want EntityTooSmall", err)
+	}
+	f.mu.Lock()
+	pending := len(f.uploads)
+	f.mu.Unlock()
+	if f.count("AbortMultipartUpload") != 1 || pending != 0 {
+		t.Errorf("multipart upload not aborted: %d aborts, %d uploads left", f.count("AbortMultipartUpload"), pending)
+	}
+	if _, err := s.Stat("small"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat of the failed object: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3StorageErrors(t *testing.T) {
+	f, srv := newFakeS3(t)
+
+	// Only a missing object matches os.ErrNotExist, not a missing bucket
+	s := f.storage(t, srv, f.secret)
+	s.opts.Bucket = "other"
+	if _, err := s.OpenRange("key", 0, -1); err == nil || errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("missing bucket: got %v, want a NoSuchBucket error", err)
+	}
+
+	bad := f.storage(t, srv, "wrong secret")
+	if _, err := bad.List(""); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("wrong secret: got %v, want SignatureDoesNotMatch", err)
+	}
+}
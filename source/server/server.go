@@ -2,150 +2,385 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Session close codes sent to clients in the WebTransport CLOSE_SESSION capsule.
+const (
+	sessionCloseNormal    webtransport.SessionErrorCode = 0
+	sessionCloseGoingAway webtransport.SessionErrorCode = 1001
+
+	// sessionCloseIncompatible rejects clients that do not speak a supported
+	// protocol version.
+	sessionCloseIncompatible webtransport.SessionErrorCode = 1002
+
+	// sessionCloseTooSlow disconnects a client whose outbound queue
+	// overflowed under the disconnect policy.
+	sessionCloseTooSlow webtransport.SessionErrorCode = 1008
 )
 
+// flushTimeout bounds how long a client's send loop may take to drain its
+// queue when the server closes the session.
+const flushTimeout = 2 * time.Second
+
 // MessageServer manages connected clients and broadcasting messages.
 type MessageServer struct {
-	listeners map[string]*Client
+	listeners map[int]*Client // keyed by session ID
 	mutex     sync.Mutex
+
+	// fanout serializes deliveries into client queues; see deliverAndUnlock.
+	fanout   sync.Mutex
+	outbound outboundStats
+
+	// publishMutex serializes changes to the version indexes of shared
+	// files.
+	publishMutex sync.Mutex
+
+	channels    map[string]*Channel
+	memberships map[string]*membership // keyed by Principal.Subject
+
+	config     *Config
+	bufferPool *sync.Pool
+	history    *History
+	uploads    *UploadRegistry
+	storage    Storage
+	blobs      *BlobStore
+	catalog    map[string]versionIndex // version indexes by file name, guarded by publishMutex
+	receipts   *receiptTracker
+	typing     map[typingKey]*time.Timer
+
+	shuttingDown    bool
+	activeTransfers atomic.Int64
 }
 
-// NewMessageServer creates a new MessageServer instance.
-func NewMessageServer() *MessageServer {
+// NewMessageServer creates a new MessageServer instance that records
+// channel events in history, stages file uploads in uploads and keeps the
+// version indexes of shared files in storage and their content in blobs.
+func NewMessageServer(cfg *Config, history *History, uploads *UploadRegistry, storage Storage, blobs *BlobStore) *MessageServer {
 	return &MessageServer{
-		listeners: make(map[string]*Client),
+		listeners: make(map[int]*Client),
+		channels: map[string]*Channel{
+			defaultChannel: {Name: defaultChannel, CreatedBy: "server", CreatedAt: time.Now()},
+		},
+		memberships: make(map[string]*membership),
+		config:      cfg,
+		bufferPool:  newBufferPool(int(cfg.ChunkSize)),
+		history:     history,
+		uploads:     uploads,
+		storage:     storage,
+		blobs:       blobs,
+		catalog:     make(map[string]versionIndex),
+		receipts:    newReceiptTracker(),
+		typing:      make(map[typingKey]*time.Timer),
 	}
 }
 
-// AddClient registers a new client with the server.
+// AddClient registers a new client with the server. If another connected
+// client already uses the requested display name, c.Name is suffixed with
+// the lowest free number, e.g. "Anonymous (2)".
 func (m *MessageServer) AddClient(c *Client) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.listeners[c.Name] = c
-	log.Printf("Client added: %s. Total clients: %d", c.Name, len(m.listeners))
+	c.Name = m.uniqueNameLocked(c.Name)
+	c.Presence = presenceOnline
+	c.queue = newOutboundQueue(c.Name, m.config, &m.outbound, func() {
+		log.Printf("[WARN] Disconnecting %s: outbound queue overflowed", c.Name)
+		c.Session.CloseWithError(sessionCloseTooSlow, "client too slow to keep up")
+	})
+	m.listeners[c.ID] = c
+	m.restoreMembershipLocked(c)
+	log.Printf("Client added: #%d %s. Total clients: %d", c.ID, c.Name, len(m.listeners))
 }
 
-// RemoveClient removes a client by name.
-func (m *MessageServer) RemoveClient(name string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	if c, ok := m.listeners[name]; ok {
-		close(c.Ch)
-		delete(m.listeners, name)
-		log.Printf("Client removed: %s. Total clients: %d", name, len(m.listeners))
+// uniqueNameLocked returns name, or name with a numeric suffix if it is
+// already taken. The caller must hold m.mutex.
+func (m *MessageServer) uniqueNameLocked(name string) string {
+	taken := make(map[string]bool, len(m.listeners))
+	for _, c := range m.listeners {
+		taken[strings.ToLower(c.Name)] = true
+	}
+	if !taken[strings.ToLower(name)] {
+		return name
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
 	}
 }
 
-// Broadcast sends a message to all connected clients.
-func (m *MessageServer) Broadcast(message []byte) {
+// RemoveClient removes a client by session ID.
+func (m *MessageServer) RemoveClient(id int) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	for _, c := range m.listeners {
-		select {
-		case c.Ch <- message:
-		default:
-			log.Printf("[WARN] Channel full for client %s, skipping message.", c.Name)
+	if c, ok := m.listeners[id]; ok {
+		c.queue.close()
+		delete(m.listeners, id)
+		if ms, ok := m.memberships[c.Principal.Subject]; ok {
+			ms.lastSeen = time.Now()
+			ms.name = c.Name
+		}
+		if dropped := c.queue.dropped.Load(); dropped > 0 {
+			log.Printf("[WARN] Client %s lost %d outbound messages", c.Name, dropped)
 		}
+		log.Printf("Client removed: #%d %s. Total clients: %d", id, c.Name, len(m.listeners))
 	}
 }
 
-// BroadcastOnlineList sends the list of currently online users to all clients.
-func (m *MessageServer) BroadcastOnlineList() {
+// SendMessage queues a message for a single client.
+func (m *MessageServer) SendMessage(c *Client, message []byte) {
+	m.sendQueued(c, outboundMessage{data: message})
+}
+
+// sendState queues a state snapshot for c. Under the coalesce policy a
+// newer snapshot with the same key replaces one that is still queued.
+func (m *MessageServer) sendState(c *Client, key string, message []byte) {
+	m.sendQueued(c, outboundMessage{data: message, key: key})
+}
+
+func (m *MessageServer) sendQueued(c *Client, msg outboundMessage) {
 	m.mutex.Lock()
-	names := make([]string, 0, len(m.listeners))
-	for name := range m.listeners {
-		names = append(names, name)
+	if _, ok := m.listeners[c.ID]; !ok {
+		m.mutex.Unlock()
+		return
 	}
-	m.mutex.Unlock() // Unlock early before marshaling and sending
+	m.deliverAndUnlock([]*Client{c}, msg)
+}
 
-	data, err := json.Marshal(map[string]interface{}{
-		"type":    "online",
-		"clients": names,
-	})
-	if err != nil {
-		log.Printf("Error marshaling online list: %v", err)
+// Broadcast stamps event with an id and server time and sends it to all
+// connected clients.
+func (m *MessageServer) Broadcast(event map[string]interface{}) {
+	m.mutex.Lock()
+	message := m.stampLocked("", event)
+	if message == nil {
+		m.mutex.Unlock()
 		return
 	}
+	targets := make([]*Client, 0, len(m.listeners))
+	for _, c := range m.listeners {
+		targets = append(targets, c)
+	}
+	m.deliverAndUnlock(targets, outboundMessage{data: message})
+}
 
+// stampLocked records event in the history, which assigns its monotonic id
+// and RFC3339 server time, and returns the encoded event. Events without a
+// channel (direct messages and server-wide notices) only get an id and are
+// not recorded. Stamping while m.mutex is held keeps delivery order
+// identical to id order. The caller must hold m.mutex.
+func (m *MessageServer) stampLocked(channel string, event map[string]interface{}) []byte {
+	var message []byte
+	var err error
+	if channel == "" {
+		message, err = m.history.Stamp(event)
+	} else {
+		message, err = m.history.Append(channel, event)
+	}
+	if err == nil {
+		return message
+	}
+
+	log.Printf("[WARN] Failed to record %v event: %v", event["type"], err)
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if channel != "" {
+		event["channel"] = channel
+	}
+	if message, err = json.Marshal(event); err != nil {
+		log.Printf("Error marshaling %v event: %v", event["type"], err)
+		return nil
+	}
+	return message
+}
+
+// BroadcastOnlineList sends each channel's list of online members, with
+// their presence, to the members of that channel. Like every state update it
+// travels on the reliable persistent stream; under the coalesce policy a
+// queued list is replaced by the newer one.
+func (m *MessageServer) BroadcastOnlineList() {
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	log.Printf("Broadcasting online list to %d clients.", len(m.listeners))
+
+	online := make(map[string]bool, len(m.listeners))
 	for _, c := range m.listeners {
-		if err := c.Session.SendDatagram(data); err != nil {
-			log.Printf("Failed to send online list to %s: %v", c.Name, err)
+		online[c.Principal.Subject] = true
+	}
+
+	var deliveries []delivery
+	for name := range m.channels {
+		members := m.channelMembersLocked(name)
+		if len(members) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(m.onlineListLocked(name, members, online))
+		if err != nil {
+			log.Printf("Error marshaling online list: %v", err)
+			continue
 		}
+
+		log.Printf("Broadcasting online list of #%s to %d clients.", name, len(members))
+		deliveries = append(deliveries, delivery{members, outboundMessage{data: data, key: "online:" + name}})
 	}
+	m.deliverBatchAndUnlock(deliveries)
 }
 
-// BroadcastFileList sends the list of available files to all clients.
-func (m *MessageServer) BroadcastFileList() {
-	fileList := getFileList()
+// fileListMessage encodes the current file list, read from the catalog.
+// The caller must hold m.publishMutex.
+func (m *MessageServer) fileListMessage() ([]byte, int, error) {
+	fileList := m.catalogListLocked()
 	data, err := json.Marshal(map[string]interface{}{
 		"type":  "file_list",
 		"files": fileList,
 	})
+	return data, len(fileList), err
+}
+
+// BroadcastFileListDelta tells all clients about the files called names,
+// which were added, changed or removed. Clients that negotiated the
+// "file_list_delta" feature get just those entries as
+// {"type":"file_list_delta","removed":[...],"files":[...]}; the others get
+// the whole list, as from SendFileList. Entries are read from the catalog
+// and queued while holding m.publishMutex, so deltas arrive in the order of the
+// changes they describe.
+func (m *MessageServer) BroadcastFileListDelta(names ...string) {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	removed := []string{}
+	files := make([]fileMeta, 0, len(names))
+	for _, name := range names {
+		if idx, ok := m.catalog[name]; ok {
+			files = append(files, newFileMeta(name, idx.Versions))
+		} else {
+			removed = append(removed, name)
+		}
+	}
+	delta, err := json.Marshal(map[string]interface{}{
+		"type":    "file_list_delta",
+		"removed": removed,
+		"files":   files,
+	})
+	if err != nil {
+		log.Printf("Error marshaling file list delta: %v", err)
+		return
+	}
+	full, _, err := m.fileListMessage()
 	if err != nil {
 		log.Printf("Error marshaling file list: %v", err)
 		return
 	}
 
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	log.Printf("Broadcasting file list (%d files) to %d clients.", len(fileList), len(m.listeners))
+	var deltaTargets, fullTargets []*Client
 	for _, c := range m.listeners {
-		if err := c.Session.SendDatagram(data); err != nil {
-			log.Printf("Failed to send file list to %s: %v", c.Name, err)
+		if c.Features["file_list_delta"] {
+			deltaTargets = append(deltaTargets, c)
+		} else {
+			fullTargets = append(fullTargets, c)
 		}
 	}
+	log.Printf("Broadcasting file list delta (%d removed, %d changed) to %d clients, full list to %d clients.",
+		len(removed), len(files), len(deltaTargets), len(fullTargets))
+	m.deliverBatchAndUnlock([]delivery{
+		{deltaTargets, outboundMessage{data: delta}},
+		{fullTargets, outboundMessage{data: full, key: "file_list"}},
+	})
 }
 
-// SendFileList sends the file list to a single, specific client.
+// SendFileList sends the file list to a single, specific client. Like a
+// delta it is read and queued under m.publishMutex, so a delta queued after
+// it never describes an older state.
 func (m *MessageServer) SendFileList(c *Client) {
-	fileList := getFileList()
-	data, err := json.Marshal(map[string]interface{}{
-		"type":  "file_list",
-		"files": fileList,
-	})
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	data, n, err := m.fileListMessage()
 	if err != nil {
 		log.Printf("Error marshaling file list for %s: %v", c.Name, err)
 		return
 	}
+	m.sendState(c, "file_list", data)
+	log.Printf("Sent file list (%d files) to %s.", n, c.Name)
+}
 
-	if err := c.Session.SendDatagram(data); err != nil {
-		log.Printf("Failed to send file list to %s: %v", c.Name, err)
-	} else {
-		log.Printf("Sent file list (%d files) to %s.", len(fileList), c.Name)
-	}
+// IsShuttingDown reports whether Shutdown has been called.
+func (m *MessageServer) IsShuttingDown() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.shuttingDown
 }
 
-// getFileList reads the 'uploads' directory and returns a list of files.
-func getFileList() []map[string]interface{} {
-	files, err := os.ReadDir("uploads")
-	if err != nil {
-		log.Printf("Error reading 'uploads' directory: %v", err)
-		return []map[string]interface{}{}
+// trackTransfer marks a file or drawing stream as in flight. The returned
+// function must be called when the stream is finished.
+func (m *MessageServer) trackTransfer() func() {
+	m.activeTransfers.Add(1)
+	return func() { m.activeTransfers.Add(-1) }
+}
+
+// Shutdown stops accepting new sessions, notifies every client, waits up to
+// grace for in-flight transfers and finally closes all sessions.
+func (m *MessageServer) Shutdown(grace time.Duration) {
+	m.mutex.Lock()
+	m.shuttingDown = true
+	m.mutex.Unlock()
+
+	m.Broadcast(map[string]interface{}{
+		"type":    "system",
+		"message": "Server is shutting down. Please reconnect in a moment.",
+	})
+
+	deadline := time.Now().Add(grace)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for m.activeTransfers.Load() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	ticker.Stop()
+	if n := m.activeTransfers.Load(); n > 0 {
+		log.Printf("[WARN] Grace period elapsed with %d transfers still running", n)
+	} else {
+		log.Println("All transfers finished")
 	}
 
-	var fileList []map[string]interface{}
-	for _, f := range files {
-		// Skip directories and temporary/hidden files
-		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || strings.HasSuffix(f.Name(), ".tmp") || strings.Contains(f.Name(), ".part") {
-			continue
-		}
+	m.closeAllSessions(sessionCloseGoingAway, "server shutting down")
 
-		info, err := f.Info()
-		if err != nil {
-			continue
-		}
+	// Unfinished uploads stay on disk so clients can resume them after a restart
+	if n := m.uploads.Len(); n > 0 {
+		log.Printf("Keeping %d unfinished uploads for resumption", n)
+	}
+}
+
+// closeAllSessions flushes each client's queue and closes its session.
+func (m *MessageServer) closeAllSessions(code webtransport.SessionErrorCode, reason string) {
+	m.mutex.Lock()
+	clients := make([]*Client, 0, len(m.listeners))
+	for _, c := range m.listeners {
+		clients = append(clients, c)
+	}
+	m.mutex.Unlock()
 
-		fileList = append(fileList, map[string]interface{}{
-			"name": info.Name(),
-			"size": info.Size(),
-		})
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.requestFlush()
+			select {
+			case <-c.flushed:
+			case <-time.After(flushTimeout):
+				log.Printf("[WARN] Timed out flushing messages for %s", c.Name)
+			}
+			if err := c.Session.CloseWithError(code, reason); err != nil {
+				log.Printf("Failed to close session of %s: %v", c.Name, err)
+			}
+		}(c)
 	}
-	return fileList
+	wg.Wait()
+	log.Printf("Closed %d sessions", len(clients))
 }
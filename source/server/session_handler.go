@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"sync"
 	"time"
 
@@ -15,41 +15,79 @@ import (
 )
 
 // handleWebTransportSession manages a new client connection.
-func handleWebTransportSession(messageServer *MessageServer, sessionID int, session *webtransport.Session, r *http.Request) {
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		name = "Anonymous"
-	}
-	log.Printf("Session #%d started. Client: %s", sessionID, name)
+func handleWebTransportSession(messageServer *MessageServer, sessionID int, session *webtransport.Session, principal *Principal) {
+	requestedName := principal.Name
+	log.Printf("Session #%d started. Client: %s", sessionID, requestedName)
 
 	// Open a persistent unidirectional stream for server->client messages
 	sendStream, err := session.OpenUniStream()
 	if err != nil {
-		log.Printf("[%s] Failed to open persistent UniStream: %s", name, err)
+		log.Printf("[%s] Failed to open persistent UniStream: %s", requestedName, err)
+		return
+	}
+
+	// The client introduces itself before anything else happens
+	hello, err := awaitHello(session.Context(), session, int(messageServer.config.MaxHeaderSize))
+	if err != nil {
+		log.Printf("[%s] Handshake failed: %v", requestedName, err)
+		reason := "handshake failed"
+		if errors.Is(err, errIncompatible) {
+			reason = err.Error()
+		}
+		session.CloseWithError(sessionCloseIncompatible, reason)
+		return
+	}
+	features := negotiateFeatures(hello.Features)
+	if err := writeFrame(sendStream, messageServer.welcomeMessage(features)); err != nil {
+		log.Printf("[%s] Failed to send welcome: %v", requestedName, err)
 		return
 	}
 
 	client := &Client{
-		Name:       name,
+		ID:         sessionID,
+		Name:       requestedName,
+		Principal:  principal,
+		Protocol:   hello.ProtocolVersion,
+		Features:   features,
 		Session:    session,
-		Ch:         make(chan []byte, 256),
 		SendStream: sendStream,
+		closing:    make(chan struct{}),
+		flushed:    make(chan struct{}),
 	}
 
 	messageServer.AddClient(client)
+	name := client.Name
+
+	// Tell the client which identity it was given; the name may carry a suffix
+	identity := map[string]interface{}{"type": "identity", "id": client.ID, "name": name}
+	if principal.ResumeToken != "" {
+		identity["resume_token"] = principal.ResumeToken
+	}
+	identityMsg, _ := json.Marshal(identity)
+	messageServer.SendMessage(client, identityMsg)
+	messageServer.sendChannelList(client)
+
 	messageServer.BroadcastOnlineList()
 	messageServer.SendFileList(client)
 
-	// Announce join
-	joinMsg, _ := json.Marshal(map[string]string{"type": "system", "message": name + " joined the chat."})
-	messageServer.Broadcast(joinMsg)
+	// Replay recent history, then announce the join in every channel the
+	// identity belongs to
+	for _, channel := range messageServer.ClientChannels(client) {
+		messageServer.sendBackfill(client, channel)
+		messageServer.BroadcastToChannel(channel, nil, map[string]interface{}{"type": "system", "message": name + " joined the chat."})
+	}
 
 	// Defer cleanup
 	defer func() {
-		messageServer.RemoveClient(name)
+		channels := messageServer.ClientChannels(client)
+		messageServer.StopAllTyping(client)
+		messageServer.RemoveClient(client.ID)
+		// Already closed if the client left or the server shut it down
+		session.CloseWithError(sessionCloseNormal, "")
 		messageServer.BroadcastOnlineList()
-		leaveMsg, _ := json.Marshal(map[string]string{"type": "system", "message": name + " left the chat."})
-		messageServer.Broadcast(leaveMsg)
+		for _, channel := range channels {
+			messageServer.BroadcastToChannel(channel, nil, map[string]interface{}{"type": "system", "message": name + " left the chat."})
+		}
 		log.Printf("Session #%d closed. Client: %s", sessionID, name)
 	}()
 
@@ -57,20 +95,36 @@ func handleWebTransportSession(messageServer *MessageServer, sessionID int, sess
 	ctx, cancel := context.WithCancel(session.Context())
 	defer cancel()
 
-	// Goroutine for sending messages from channel to client
+	// Goroutine for sending queued messages to the client, one frame each
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer close(client.flushed)
 		defer sendStream.Close()
 		for {
-			select {
-			case msg := <-client.Ch:
-				_, err := sendStream.Write(msg)
-				if err != nil {
+			if msg, ok := client.queue.pop(); ok {
+				if err := writeFrame(sendStream, msg); err != nil {
 					log.Printf("[%s] Send stream failed: %v", name, err)
 					cancel()
 					return
 				}
+				continue
+			}
+			select {
+			case <-client.queue.ready:
+			case <-client.closing:
+				// Drain whatever is still queued before the session is closed
+				for {
+					msg, ok := client.queue.pop()
+					if !ok {
+						return
+					}
+					if err := writeFrame(sendStream, msg); err != nil {
+						return
+					}
+				}
+			case <-client.queue.done:
+				return
 			case <-ctx.Done():
 				return
 			}
@@ -92,6 +146,19 @@ func handleWebTransportSession(messageServer *MessageServer, sessionID int, sess
 		}
 	}()
 
+	// Goroutine for receiving datagrams (typing indicators)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			data, err := session.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			handleDatagram(messageServer, client, data)
+		}
+	}()
+
 	// Goroutine for accepting bidirectional streams and routing them
 	wg.Add(1)
 	go func() {
@@ -112,51 +179,14 @@ func handleWebTransportSession(messageServer *MessageServer, sessionID int, sess
 	wg.Wait()
 }
 
-// routeBidirectionalStream reads the first few bytes to determine stream type
-func routeBidirectionalStream(ctx context.Context, messageServer *MessageServer, client *Client, stream *webtransport.Stream) {
-	defer stream.Close()
+// handleFileStream handles the begin, query, upload, merge, download,
+// versions, stat, delete and rename operations.
+// The stream carries a newline-terminated JSON header followed by the
+// operation's data.
+func handleFileStream(_ context.Context, server *MessageServer, client *Client, s *webtransport.Stream, r io.Reader) {
+	reader := bufio.NewReader(r)
 
-	peekBuf := make([]byte, 8) // Read first 8 bytes
-	n, err := stream.Read(peekBuf)
-	if err != nil && err != io.EOF {
-		log.Printf("[%s] Error peeking stream: %v", client.Name, err)
-		return
-	}
-
-	if n == 0 {
-		log.Printf("[%s] Empty stream received", client.Name)
-		return
-	}
-
-	if n >= 4 {
-		headerLen := uint32(peekBuf[0])<<24 | uint32(peekBuf[1])<<16 | uint32(peekBuf[2])<<8 | uint32(peekBuf[3])
-
-		if headerLen > 10 && headerLen < 1000 && (n < 5 || peekBuf[4] == '{' || peekBuf[4] == ' ') {
-			log.Printf("[%s] Routing to drawing handler (detected length-prefix: %d)", client.Name, headerLen)
-			handleDrawingStreamWithPeek(messageServer, client, stream, peekBuf[:n])
-			return
-		}
-	}
-
-	// Check if it starts with JSON
-	if peekBuf[0] == '{' {
-		log.Printf("[%s] Routing to file handler (detected JSON)", client.Name)
-		handleFileStreamWithPeek(ctx, messageServer, client, stream, peekBuf[:n])
-		return
-	}
-
-	// Default to file handler for backward compatibility
-	log.Printf("[%s] Routing to file handler (default)", client.Name)
-	handleFileStreamWithPeek(ctx, messageServer, client, stream, peekBuf[:n])
-}
-
-// handleFileStreamWithPeek handles file operations with already-read peek bytes
-func handleFileStreamWithPeek(_ context.Context, server *MessageServer, client *Client, s *webtransport.Stream, peekData []byte) {
-	// Create a multi-reader that includes peek data
-	reader := io.MultiReader(&bytesReader{data: peekData}, s)
-
-	// Read header from combined reader
-	hdr, err := readStreamHeaderFromReader(reader)
+	hdr, err := readStreamHeaderFromReader(reader, int(server.config.MaxHeaderSize))
 	if err != nil {
 		log.Printf("[%s] Error reading stream header: %v", client.Name, err)
 		writeJSONResult(s, map[string]string{"status": "error", "error": err.Error()})
@@ -178,36 +208,46 @@ func handleFileStreamWithPeek(_ context.Context, server *MessageServer, client *
 	wrappedReader := &readerStream{s: s, r: reader}
 
 	switch hdr.Op {
+	case "begin":
+		handleBegin(server, client, s, hdr)
+	case "query":
+		handleQuery(server, client, s, hdr)
 	case "upload":
-		handleUpload(client, s, hdr, wrappedReader)
+		handleUpload(server, client, s, hdr, wrappedReader)
 	case "merge":
 		handleMerge(server, client, s, hdr)
 	case "download":
-		handleDownload(client, s, hdr)
+		handleDownload(server, client, s, hdr)
+	case "versions":
+		handleVersions(server, client, s, hdr)
+	case "stat":
+		handleStat(server, client, s, hdr)
+	case "delete":
+		handleDelete(server, client, s, hdr)
+	case "rename":
+		handleRename(server, client, s, hdr)
 	default:
 		log.Printf("[%s] Unknown file operation: %s", client.Name, hdr.Op)
 		writeJSONResult(s, map[string]string{"status": "error", "error": "unknown operation"})
 	}
 }
 
-// readStreamHeaderFromReader reads file header from a reader
-func readStreamHeaderFromReader(r io.Reader) (*fileStreamHeader, error) {
-	headerBuf := make([]byte, 0, 16*1024)
-	tmp := make([]byte, 4096)
+// readStreamHeaderFromReader reads the newline-terminated file header,
+// leaving r positioned at the first byte after the newline.
+func readStreamHeaderFromReader(r *bufio.Reader, maxSize int) (*fileStreamHeader, error) {
+	var headerBuf []byte
 	for {
-		n, err := r.Read(tmp)
-		if n > 0 {
-			headerBuf = append(headerBuf, tmp[:n]...)
-			if i := bytes.IndexByte(headerBuf, '\n'); i >= 0 {
-				headerBuf = headerBuf[:i]
-				break
-			}
+		line, err := r.ReadSlice('\n')
+		headerBuf = append(headerBuf, line...)
+		if len(headerBuf) > maxSize+1 {
+			return nil, fmt.Errorf("header too large")
 		}
-		if err != nil {
-			return nil, fmt.Errorf("reading header failed: %w", err)
+		if err == nil {
+			headerBuf = headerBuf[:len(headerBuf)-1]
+			break
 		}
-		if len(headerBuf) > 16*1024 {
-			return nil, fmt.Errorf("header too large")
+		if err != bufio.ErrBufferFull {
+			return nil, fmt.Errorf("reading header failed: %w", err)
 		}
 	}
 
@@ -240,25 +280,72 @@ func handleChatMessage(messageServer *MessageServer, client *Client, stream *web
 	}
 
 	var msg map[string]interface{}
-	if json.Unmarshal(p, &msg) == nil {
-		msg["type"] = "chat"
-		msg["name"] = client.Name
-		b, _ := json.Marshal(msg)
-		messageServer.Broadcast(b)
+	if json.Unmarshal(p, &msg) != nil {
+		return
 	}
-}
 
-// bytesReader is a simple reader for already-read bytes
-type bytesReader struct {
-	data []byte
-	pos  int
+	msgType, _ := msg["type"].(string)
+	switch msgType {
+	case "channel_create", "channel_join", "channel_leave", "channel_list":
+		handleChannelCommand(messageServer, client, msgType, msg)
+		return
+	case "history":
+		handleHistoryRequest(messageServer, client, msg)
+		return
+	case "drawing_data":
+		handleDrawingDataRequest(messageServer, client, msg)
+		return
+	case "files":
+		handleFilesRequest(messageServer, client, msg)
+		return
+	case "stats":
+		handleStatsRequest(messageServer, client)
+		return
+	case "ack":
+		handleAck(messageServer, client, msg)
+		return
+	case "presence":
+		handlePresenceRequest(messageServer, client, msg)
+		return
+	case "dm":
+		handleDirectMessage(messageServer, client, msg)
+		return
+	case "", "chat":
+		if _, private := msg["to"]; private {
+			handleDirectMessage(messageServer, client, msg)
+			return
+		}
+	default:
+		messageServer.sendError(client, msgType, fmt.Errorf("unknown message type %q", msgType))
+		return
+	}
+
+	requested, _ := msg["channel"].(string)
+	channel, err := resolveChannel(messageServer, client, requested)
+	if err != nil {
+		messageServer.sendError(client, "chat", err)
+		return
+	}
+
+	msg["type"] = "chat"
+	msg["name"] = client.Name
+	msg["sender_id"] = client.ID
+	messageServer.SetTyping(client, channel, false)
+	messageServer.BroadcastToChannel(channel, client, msg)
 }
 
-func (r *bytesReader) Read(p []byte) (n int, err error) {
-	if r.pos >= len(r.data) {
-		return 0, io.EOF
+// resolveChannel validates the channel a message targets, defaulting to
+// the general channel, and checks that the client may post there.
+func resolveChannel(server *MessageServer, client *Client, name string) (string, error) {
+	if name == "" {
+		name = defaultChannel
+	}
+	channel, err := normalizeChannelName(name)
+	if err != nil {
+		return "", err
+	}
+	if !server.IsMember(client, channel) {
+		return "", fmt.Errorf("not a member of #%s", channel)
 	}
-	n = copy(p, r.data[r.pos:])
-	r.pos += n
-	return n, nil
+	return channel, nil
 }
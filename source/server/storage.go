@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage backends for shared files and upload parts.
+const (
+	storageLocal = "local" // files under UploadDir
+	storageS3    = "s3"    // objects in an S3-compatible bucket
+)
+
+var storageBackends = []string{storageLocal, storageS3}
+
+// Storage holds the content of shared files, their version indexes and the
+// finished parts of uploads as objects under slash-separated keys such as
+// ".blobs/ab/ab12...". Keys mirror the layout of the upload directory, so
+// the local backend stores every object at the same place as before.
+// Missing objects are reported with errors matching os.ErrNotExist.
+//
+// Upload sessions themselves, and parts still being received, stay on the
+// local disk: a part is handed over with PutPart once it is complete.
+type Storage interface {
+	// PutPart moves the finished local file at path into storage under key,
+	// replacing any object stored there. The local file is gone afterwards.
+	PutPart(key, path string) error
+
+	// Compose stores the concatenation of the objects parts under dst.
+	Compose(dst string, parts []string) error
+
+	// OpenRange opens length bytes of the object key starting at offset; a
+	// negative length reads to the end.
+	OpenRange(key string, offset, length int64) (io.ReadCloser, error)
+
+	Stat(key string) (StorageObject, error)
+
+	// List returns the objects whose keys start with prefix, in no
+	// particular order.
+	List(prefix string) ([]StorageObject, error)
+
+	// Delete removes the object key. Deleting a missing object is not an
+	// error.
+	Delete(key string) error
+}
+
+// StorageObject describes an object held by a Storage.
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// OpenStorage returns the storage backend selected by cfg.
+func OpenStorage(cfg *Config) (Storage, error) {
+	switch cfg.Storage {
+	case storageLocal:
+		return NewLocalStorage(cfg.UploadDir), nil
+	case storageS3:
+		return NewS3Storage(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			Prefix:    cfg.S3Prefix,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		})
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+}
+
+// putBytes stores data under key in s, staging it in a temporary file in
+// the local directory scratch.
+func putBytes(s Storage, scratch, key string, data []byte) error {
+	f, err := os.CreateTemp(scratch, "put-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.PutPart(key, tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// readObject returns the content of the object key in s.
+func readObject(s Storage, key string) ([]byte, error) {
+	r, err := s.OpenRange(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// LocalStorage keeps objects as files under a root directory, the key
+// being the path relative to it.
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage returns a Storage keeping its objects under root.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (l *LocalStorage) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (l *LocalStorage) PutPart(key, src string) error {
+	dst := l.path(key)
+	if filepath.Clean(src) == dst {
+		// Parts are received where the object lives
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// Compose writes the parts to a temporary file next to dst and renames it
+// into place once complete, so dst never holds partial content.
+func (l *LocalStorage) Compose(dst string, parts []string) error {
+	dstPath := l.path(dst)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dstPath), ".compose-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	for _, key := range parts {
+		pf, err := os.Open(l.path(key))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(f, pf)
+		pf.Close()
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dstPath)
+}
+
+// OpenRange opens the file itself, so the content stays readable even if
+// the object is deleted meanwhile.
+func (l *LocalStorage) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (l *LocalStorage) Stat(key string) (StorageObject, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if info.IsDir() {
+		return StorageObject{}, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *LocalStorage) List(prefix string) ([]StorageObject, error) {
+	// Walk the deepest directory the prefix names and filter below it
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	var objects []StorageObject
+	err := filepath.WalkDir(l.path(dir), func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (l *LocalStorage) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the checks every Storage backend must pass. scratch is
+// the local directory parts are staged in before PutPart.
+func testStorage(t *testing.T, s Storage, scratch string) {
+	put := func(t *testing.T, key string, data []byte) {
+		t.Helper()
+		if err := putBytes(s, scratch, key, data); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	read := func(t *testing.T, key string) []byte {
+		t.Helper()
+		data, err := readObject(s, key)
+		if err != nil {
+			t.Fatalf("read %s: %v", key, err)
+		}
+		return data
+	}
+
+	t.Run("PutPart", func(t *testing.T) {
+		part := filepath.Join(scratch, "part")
+		if err := os.WriteFile(part, []byte("part content"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutPart(".uploads/id/0", part); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(part); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("local part still there after PutPart: %v", err)
+		}
+		if got := read(t, ".uploads/id/0"); string(got) != "part content" {
+			t.Errorf("got %q", got)
+		}
+
+		put(t, ".uploads/id/0", []byte("replaced"))
+		if got := read(t, ".uploads/id/0"); string(got) != "replaced" {
+			t.Errorf("after replacing: got %q", got)
+		}
+	})
+
+	t.Run("OpenRange", func(t *testing.T) {
+		key := "files/with space+é.txt"
+		put(t, key, []byte("0123456789"))
+		for _, tc := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "0123456789"},
+			{4, -1, "456789"},
+			{2, 3, "234"},
+			{0, 0, ""},
+			{7, 100, "789"},
+		} {
+			r, err := s.OpenRange(key, tc.offset, tc.length)
+			if err != nil {
+				t.Fatalf("OpenRange(%d, %d): %v", tc.offset, tc.length, err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != tc.want {
+				t.Errorf("OpenRange(%d, %d) = %q, %v; want %q", tc.offset, tc.length, got, err, tc.want)
+			}
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		put(t, "stat/object", []byte("12345"))
+		obj, err := s.Stat("stat/object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Key != "stat/object" || obj.Size != 5 || obj.ModTime.IsZero() {
+			t.Errorf("got %+v", obj)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, err := s.Stat("missing/object"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat: got %v, want os.ErrNotExist", err)
+		}
+		if _, err := s.OpenRange("missing/object", 0, -1); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("OpenRange: got %v, want os.ErrNotExist", err)
+		}
+		if _, err := s.OpenRange("missing/object", 0, 0); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("OpenRange of 0 bytes: got %v, want os.ErrNotExist", err)
+		}
+		if err := s.Compose("missing/composed", []string{"missing/object"}); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Compose: got %v, want os.ErrNotExist", err)
+		}
+		if err := s.Delete("missing/object"); err != nil {
+			t.Errorf("Delete: %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		for _, key := range []string{"list/a", "list/b", "list/sub/c", "listx/d", "other/e"} {
+			put(t, key, []byte(key))
+		}
+		for _, tc := range []struct {
+			prefix string
+			want   []string
+		}{
+			{"list/", []string{"list/a", "list/b", "list/sub/c"}},
+			{"list", []string{"list/a", "list/b", "list/sub/c", "listx/d"}},
+			{"list/sub/", []string{"list/sub/c"}},
+			{"nothing/", nil},
+		} {
+			objects, err := s.List(tc.prefix)
+			if err != nil {
+				t.Fatalf("List(%q): %v", tc.prefix, err)
+			}
+			var got []string
+			for _, obj := range objects {
+				got = append(got, obj.Key)
+				if obj.Size != int64(len(obj.Key)) {
+					t.Errorf("List(%q): %s has size %d", tc.prefix, obj.Key, obj.Size)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("List(%q) = %v, want %v", tc.prefix, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		put(t, "delete/object", []byte("x"))
+		if err := s.Delete("delete/object"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat("delete/object"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat after Delete: got %v, want os.ErrNotExist", err)
+		}
+	})
+
+	t.Run("Compose", func(t *testing.T) {
+		// Small parts, and parts large enough to be copied by S3
+		for name, sizes := range map[string][]int{
+			"small": {3, 1, 5},
+			"large": {s3MinCopyPart, s3MinCopyPart, 10},
+		} {
+			var parts []string
+			var want []byte
+			for i, n := range sizes {
+				data := bytes.Repeat([]byte{byte('a' + i)}, n)
+				key := ".uploads/" + name + "/" + string(rune('0'+i))
+				put(t, key, data)
+				parts = append(parts, key)
+				want = append(want, data...)
+			}
+			dst := ".blobs/" + name
+			if err := s.Compose(dst, parts); err != nil {
+				t.Fatalf("Compose %s: %v", name, err)
+			}
+			if got := read(t, dst); !bytes.Equal(got, want) {
+				t.Errorf("Compose %s: got %d bytes, want %d", name, len(got), len(want))
+			}
+			if got := read(t, parts[0]); len(got) != sizes[0] {
+				t.Errorf("Compose %s changed its first part", name)
+			}
+		}
+	})
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	testStorage(t, NewLocalStorage(root), root)
+}
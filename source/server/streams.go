@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// Every client-initiated bidirectional stream starts with a one-byte stream
+// type. The rest of the stream is handed to the handler registered for that
+// type, which reads its own header from r.
+const (
+	streamTypeFile    byte = 0x01 // file operations: begin, query, upload, merge, download, versions, stat, delete, rename
+	streamTypeDrawing byte = 0x02 // length-prefixed drawing header + PNG data
+)
+
+// streamHandler serves one bidirectional stream. r yields the bytes that
+// follow the stream-type tag; responses are written to s.
+type streamHandler func(ctx context.Context, server *MessageServer, client *Client, s *webtransport.Stream, r io.Reader)
+
+// streamHandlers maps stream types to their handlers. A new kind of stream
+// only needs a new type constant and an entry here.
+var streamHandlers = map[byte]struct {
+	name    string
+	handler streamHandler
+}{
+	streamTypeFile:    {"file", handleFileStream},
+	streamTypeDrawing: {"drawing", handleDrawingStream},
+}
+
+// routeBidirectionalStream reads the stream-type tag and dispatches the
+// stream to the registered handler. Unknown types are answered with a
+// structured error.
+func routeBidirectionalStream(ctx context.Context, messageServer *MessageServer, client *Client, stream *webtransport.Stream) {
+	defer stream.Close()
+	defer messageServer.trackTransfer()()
+
+	var tag [1]byte
+	if _, err := io.ReadFull(stream, tag[:]); err != nil {
+		if err == io.EOF {
+			log.Printf("[%s] Empty stream received", client.Name)
+		} else {
+			log.Printf("[%s] Error reading stream type: %v", client.Name, err)
+		}
+		return
+	}
+
+	entry, ok := streamHandlers[tag[0]]
+	if !ok {
+		log.Printf("[%s] Rejected stream with unknown type 0x%02x", client.Name, tag[0])
+		writeJSONResult(stream, map[string]interface{}{
+			"status": "error",
+			"code":   "unknown_stream_type",
+			"error":  fmt.Sprintf("unknown stream type 0x%02x", tag[0]),
+		})
+		stream.CancelRead(0)
+		return
+	}
+
+	log.Printf("[%s] Routing to %s handler", client.Name, entry.name)
+	entry.handler(ctx, messageServer, client, stream, stream)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// uploadsDirName is the hidden directory under UploadDir where unfinished
+// uploads are staged, one subdirectory per upload ID. Finished parts are
+// kept in storage under the same prefix, so with local storage they simply
+// stay where they were received.
+const uploadsDirName = ".uploads"
+
+// uploadStateFile holds the persisted uploadState inside an upload's directory.
+const uploadStateFile = "upload.json"
+
+// maxUploadsPerOwner limits how many unfinished uploads one identity may
+// keep at a time.
+const maxUploadsPerOwner = 16
+
+// maxUploadParts limits how many parts an upload may be split into.
+const maxUploadParts = 1024
+
+var (
+	uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	sha256Pattern   = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
+
+var (
+	errUploadNotFound = errors.New("unknown or expired upload")
+	errPartBusy       = errors.New("part is already being uploaded")
+	errUploadMerging  = errors.New("upload is being merged")
+)
+
+// uploadManifest is what the client declares when it begins an upload: the
+// file size, how it is split into parts and, optionally, the SHA-256 of the
+// whole file and of every part. Merge validates the parts against it. The
+// description and tags are recorded with the published version.
+type uploadManifest struct {
+	Filename    string   `json:"filename"`
+	Size        int64    `json:"size"`
+	PartSize    int64    `json:"part_size"`
+	NumParts    int      `json:"num_parts"`
+	Hash        string   `json:"hash,omitempty"`
+	PartHashes  []string `json:"part_hashes,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// newUploadManifest validates the layout requested in a begin header. The
+// client gives the number of parts, the part size, or both; without either
+// the file is split into defaultParts parts.
+func newUploadManifest(hdr *fileStreamHeader, maxSize int64, defaultParts int) (*uploadManifest, error) {
+	if hdr.Filename == "" || hdr.Filename == "." {
+		return nil, errors.New("filename is required")
+	}
+	if hdr.Size < 0 || hdr.Size > maxSize {
+		return nil, errors.New("file too large")
+	}
+	if hdr.NumParts < 0 || hdr.PartSize < 0 {
+		return nil, errors.New("invalid part layout")
+	}
+
+	m := &uploadManifest{Filename: hdr.Filename, Size: hdr.Size, Hash: hdr.Hash, PartHashes: hdr.PartHashes}
+	m.Description = strings.TrimSpace(hdr.Description)
+	if utf8.RuneCountInString(m.Description) > maxDescriptionLen {
+		return nil, fmt.Errorf("description must be at most %d characters", maxDescriptionLen)
+	}
+	tags, err := normalizeTags(hdr.Tags)
+	if err != nil {
+		return nil, err
+	}
+	m.Tags = tags
+	switch {
+	case hdr.Size == 0:
+		m.NumParts, m.PartSize = 1, 0
+	case hdr.PartSize > 0:
+		m.PartSize = hdr.PartSize
+		m.NumParts = int((hdr.Size + hdr.PartSize - 1) / hdr.PartSize)
+		if hdr.NumParts > 0 && hdr.NumParts != m.NumParts {
+			return nil, fmt.Errorf("%d parts of %d bytes do not cover %d bytes", hdr.NumParts, hdr.PartSize, hdr.Size)
+		}
+	default:
+		m.NumParts = hdr.NumParts
+		if m.NumParts == 0 {
+			m.NumParts = defaultParts
+		}
+		if int64(m.NumParts) > hdr.Size {
+			m.NumParts = int(hdr.Size)
+		}
+		m.PartSize = (hdr.Size + int64(m.NumParts) - 1) / int64(m.NumParts)
+		// Rounding up may leave trailing parts empty; drop them
+		m.NumParts = int((hdr.Size + m.PartSize - 1) / m.PartSize)
+	}
+	if m.NumParts > maxUploadParts {
+		return nil, fmt.Errorf("too many parts (max %d)", maxUploadParts)
+	}
+
+	if m.Hash != "" && !sha256Pattern.MatchString(m.Hash) {
+		return nil, errors.New("hash must be a hex SHA-256")
+	}
+	if len(m.PartHashes) > 0 {
+		if len(m.PartHashes) != m.NumParts {
+			return nil, fmt.Errorf("expected %d part hashes, got %d", m.NumParts, len(m.PartHashes))
+		}
+		for i, h := range m.PartHashes {
+			if !sha256Pattern.MatchString(h) {
+				return nil, fmt.Errorf("part hash %d must be a hex SHA-256", i)
+			}
+		}
+	}
+	return m, nil
+}
+
+// uploadState describes an upload session. It is written to disk when the
+// upload begins so that the session survives server restarts; how much of
+// each part has arrived is the size of the part file, or the whole part
+// once it has been put into storage.
+type uploadState struct {
+	ID string `json:"id"`
+	uploadManifest
+	Owner     string    `json:"owner"` // Principal.Subject of the uploader
+	OwnerName string    `json:"owner_name"`
+	Created   time.Time `json:"created"`
+}
+
+// uploadSession is an upload in progress.
+type uploadSession struct {
+	uploadState
+	dir     string
+	storage Storage
+
+	mutex   sync.Mutex
+	active  map[int]bool // parts currently being written
+	merging bool
+}
+
+// partRange returns the byte range [start, end) of part i within the file.
+func (u *uploadSession) partRange(i int) (start, end int64) {
+	start = int64(i) * u.PartSize
+	end = start + u.PartSize
+	if start > u.Size {
+		start = u.Size
+	}
+	if end > u.Size {
+		end = u.Size
+	}
+	return start, end
+}
+
+// partPath is the local file part i is received into.
+func (u *uploadSession) partPath(i int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("part%d", i))
+}
+
+// partKey is the key of part i in storage once it is complete.
+func (u *uploadSession) partKey(i int) string {
+	return path.Join(uploadsDirName, u.ID, fmt.Sprintf("part%d", i))
+}
+
+// partStoredPath marks part i as complete and put into storage.
+func (u *uploadSession) partStoredPath(i int) string {
+	return u.partPath(i) + ".stored"
+}
+
+// stored reports whether part i has been put into storage.
+func (u *uploadSession) stored(i int) bool {
+	_, err := os.Stat(u.partStoredPath(i))
+	return err == nil
+}
+
+// partHashPath holds the SHA-256 of part i once it has been received in
+// full and verified against the hash in its upload header.
+func (u *uploadSession) partHashPath(i int) string {
+	return u.partPath(i) + ".sha256"
+}
+
+// partLeaf returns the SHA-256 part i must have: the one declared in the
+// manifest or, failing that, the one verified from its upload header. It
+// returns "" when the part's hash is unknown.
+func (u *uploadSession) partLeaf(i int) string {
+	if len(u.PartHashes) > 0 {
+		return strings.ToLower(u.PartHashes[i])
+	}
+	data, err := os.ReadFile(u.partHashPath(i))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// discardParts deletes the given parts so that they are uploaded again.
+func (u *uploadSession) discardParts(parts []int) {
+	for _, i := range parts {
+		os.Remove(u.partStoredPath(i))
+		os.Remove(u.partPath(i))
+		os.Remove(u.partHashPath(i))
+		if err := u.storage.Delete(u.partKey(i)); err != nil {
+			log.Printf("Failed to remove part %d of upload %s: %v", i, u.ID, err)
+		}
+	}
+}
+
+// merkleRoot combines part hashes into a single hash: pairs of hashes are
+// hashed together, level by level, and an odd hash is carried up as is.
+// A file is then described by its root and the hash of every part, and a
+// mismatch pinpoints the parts to send again instead of the whole file.
+func merkleRoot(leaves []string) string {
+	level := make([][]byte, 0, len(leaves))
+	for _, leaf := range leaves {
+		b, err := hex.DecodeString(leaf)
+		if err != nil {
+			return ""
+		}
+		level = append(level, b)
+	}
+	if len(level) == 0 {
+		return ""
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// received returns how many bytes of part i the server holds.
+func (u *uploadSession) received(i int) int64 {
+	if u.stored(i) {
+		start, end := u.partRange(i)
+		return end - start
+	}
+	info, err := os.Stat(u.partPath(i))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// lastActivity is the most recent time the upload was started or written to.
+func (u *uploadSession) lastActivity() time.Time {
+	latest := u.Created
+	entries, _ := os.ReadDir(u.dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// acquirePart marks part i as being written. The returned function must be
+// called when the write is finished.
+func (u *uploadSession) acquirePart(i int) (func(), error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.merging {
+		return nil, errUploadMerging
+	}
+	if u.active[i] {
+		return nil, errPartBusy
+	}
+	u.active[i] = true
+	return func() {
+		u.mutex.Lock()
+		delete(u.active, i)
+		u.mutex.Unlock()
+	}, nil
+}
+
+// startMerge prevents further part writes. It fails while parts are still
+// being written or another merge is running.
+func (u *uploadSession) startMerge() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.merging {
+		return errUploadMerging
+	}
+	if len(u.active) > 0 {
+		return errPartBusy
+	}
+	u.merging = true
+	return nil
+}
+
+// endMerge allows part writes again after a failed merge.
+func (u *uploadSession) endMerge() {
+	u.mutex.Lock()
+	u.merging = false
+	u.mutex.Unlock()
+}
+
+func (u *uploadSession) busy() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.merging || len(u.active) > 0
+}
+
+// partStatus reports the expected and received size of every part.
+func (u *uploadSession) partStatus() []map[string]interface{} {
+	parts := make([]map[string]interface{}, u.NumParts)
+	for i := range parts {
+		start, end := u.partRange(i)
+		parts[i] = map[string]interface{}{"index": i, "size": end - start, "received": u.received(i)}
+	}
+	return parts
+}
+
+// UploadRegistry keeps track of upload sessions. Sessions that see no
+// activity for ttl are deleted together with their parts.
+type UploadRegistry struct {
+	dir     string
+	ttl     time.Duration
+	storage Storage
+
+	mutex    sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// OpenUploadRegistry loads the upload sessions staged under uploadDir by a
+// previous run and discards those that have expired. Finished parts are
+// put into storage.
+func OpenUploadRegistry(uploadDir string, ttl time.Duration, storage Storage) (*UploadRegistry, error) {
+	r := &UploadRegistry{
+		dir:      filepath.Join(uploadDir, uploadsDirName),
+		ttl:      ttl,
+		storage:  storage,
+		sessions: make(map[string]*uploadSession),
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		dir := filepath.Join(r.dir, e.Name())
+		u, err := loadUploadSession(dir, storage)
+		if err != nil || u.ID != e.Name() {
+			log.Printf("[WARN] Discarding unreadable upload %s: %v", e.Name(), err)
+			os.RemoveAll(dir)
+			continue
+		}
+		r.sessions[u.ID] = u
+	}
+	if n := r.expire(); n > 0 {
+		log.Printf("Removed %d expired uploads", n)
+	}
+	return r, nil
+}
+
+func loadUploadSession(dir string, storage Storage) (*uploadSession, error) {
+	data, err := os.ReadFile(filepath.Join(dir, uploadStateFile))
+	if err != nil {
+		return nil, err
+	}
+	u := &uploadSession{dir: dir, storage: storage, active: make(map[int]bool)}
+	if err := json.Unmarshal(data, &u.uploadState); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Len returns the number of unfinished uploads.
+func (r *UploadRegistry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sessions)
+}
+
+// Begin creates a new upload session for owner and persists it.
+func (r *UploadRegistry) Begin(owner *Client, manifest *uploadManifest) (*uploadSession, error) {
+	r.expire()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := 0
+	for _, u := range r.sessions {
+		if u.Owner == owner.Principal.Subject {
+			count++
+		}
+	}
+	if count >= maxUploadsPerOwner {
+		return nil, fmt.Errorf("too many unfinished uploads (max %d)", maxUploadsPerOwner)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	u := &uploadSession{
+		uploadState: uploadState{
+			ID:             hex.EncodeToString(id),
+			uploadManifest: *manifest,
+			Owner:          owner.Principal.Subject,
+			OwnerName:      owner.Name,
+			Created:        time.Now().UTC(),
+		},
+		storage: r.storage,
+		active:  make(map[int]bool),
+	}
+	u.dir = filepath.Join(r.dir, u.ID)
+
+	data, err := json.Marshal(u.uploadState)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(u.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(u.dir, uploadStateFile), data, 0o644); err != nil {
+		os.RemoveAll(u.dir)
+		return nil, err
+	}
+	r.sessions[u.ID] = u
+	return u, nil
+}
+
+// Get returns the upload with the given ID if it belongs to owner and has
+// not expired.
+func (r *UploadRegistry) Get(id string, owner *Client) (*uploadSession, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, errUploadNotFound
+	}
+	r.mutex.Lock()
+	u, ok := r.sessions[id]
+	r.mutex.Unlock()
+	if !ok || u.Owner != owner.Principal.Subject {
+		return nil, errUploadNotFound
+	}
+	if !u.busy() && time.Since(u.lastActivity()) > r.ttl {
+		r.Remove(u)
+		return nil, errUploadNotFound
+	}
+	return u, nil
+}
+
+// ExpiresAt returns when u will expire if it sees no further activity.
+func (r *UploadRegistry) ExpiresAt(u *uploadSession) time.Time {
+	return u.lastActivity().Add(r.ttl)
+}
+
+// Remove forgets u and deletes its staged parts, in storage and on disk.
+func (r *UploadRegistry) Remove(u *uploadSession) {
+	r.mutex.Lock()
+	delete(r.sessions, u.ID)
+	r.mutex.Unlock()
+	for i := 0; i < u.NumParts; i++ {
+		if u.stored(i) {
+			if err := r.storage.Delete(u.partKey(i)); err != nil {
+				log.Printf("Failed to remove part %d of upload %s: %v", i, u.ID, err)
+			}
+		}
+	}
+	if err := os.RemoveAll(u.dir); err != nil {
+		log.Printf("Failed to remove upload %s: %v", u.ID, err)
+	}
+}
+
+// expire removes idle uploads older than the TTL and returns how many were
+// removed.
+func (r *UploadRegistry) expire() int {
+	r.mutex.Lock()
+	var expired []*uploadSession
+	for _, u := range r.sessions {
+		if !u.busy() && time.Since(u.lastActivity()) > r.ttl {
+			expired = append(expired, u)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, u := range expired {
+		log.Printf("Upload %s of %s by %s expired", u.ID, u.Filename, u.OwnerName)
+		r.Remove(u)
+	}
+	return len(expired)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// versionsDirName is the hidden directory under UploadDir holding the
+// version index of every shared file, in a subdirectory named after the
+// file. The index is what makes a name refer to content in the blob store.
+const versionsDirName = ".versions"
+
+// versionIndexFile lists the versions of a file, and who owns it, inside its
+// directory under versionsDirName.
+const versionIndexFile = "index.json"
+
+var errVersionNotFound = errors.New("version not found")
+
+// versionIndex is the content of the version index of a file.
+type versionIndex struct {
+	// Owner is the subject (Principal.Subject) of whoever first published
+	// the file, OwnerName their name then and Created when. They are set
+	// once and survive pruning and renames; files imported from releases
+	// that kept no uploader have no owner.
+	Owner     string        `json:"owner,omitempty"`
+	OwnerName string        `json:"owner_name,omitempty"`
+	Created   time.Time     `json:"created"`
+	Versions  []fileVersion `json:"versions"` // oldest first
+
+	legacy bool // read from an index that only listed the versions
+}
+
+// fileVersion describes one version of a shared file as stored in the
+// version index. Its content is the blob for SHA256.
+type fileVersion struct {
+	Version    int       `json:"version"`
+	Uploader   string    `json:"uploader,omitempty"`
+	UploaderID string    `json:"uploader_id,omitempty"` // Principal.Subject
+	Time       time.Time `json:"time"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	MIME       string    `json:"mime,omitempty"` // sniffed from the content
+
+	// Description and Tags are supplied by the uploader.
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// public describes v for clients. The uploader's subject is left out: for
+// anonymous clients it contains their resume token.
+func (v fileVersion) public() map[string]interface{} {
+	entry := map[string]interface{}{
+		"version": v.Version,
+		"time":    v.Time.UTC().Format(time.RFC3339),
+		"size":    v.Size,
+		"sha256":  v.SHA256,
+	}
+	if v.Uploader != "" {
+		entry["uploader"] = v.Uploader
+	}
+	if v.MIME != "" {
+		entry["mime"] = v.MIME
+	}
+	if v.Description != "" {
+		entry["description"] = v.Description
+	}
+	if len(v.Tags) > 0 {
+		entry["tags"] = v.Tags
+	}
+	return entry
+}
+
+// versionKey is the key of the version index of name in storage.
+func versionKey(name string) string {
+	return path.Join(versionsDirName, name, versionIndexFile)
+}
+
+// versionsDir is where servers that kept content outside the blob store
+// stored the version index of name and its older versions.
+func versionsDir(uploadDir, name string) string {
+	return filepath.Join(uploadDir, versionsDirName, name)
+}
+
+// legacyVersionPath is where such servers stored the given older version.
+func legacyVersionPath(uploadDir, name string, version int) string {
+	return filepath.Join(versionsDir(uploadDir, name), fmt.Sprintf("v%d", version))
+}
+
+// readIndex returns the version index of name, which lists no versions for
+// a file that has no version index.
+func readIndex(s Storage, name string) (versionIndex, error) {
+	data, err := readObject(s, versionKey(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return versionIndex{}, nil
+	}
+	if err != nil {
+		return versionIndex{}, err
+	}
+	return parseIndex(name, data)
+}
+
+func parseIndex(name string, data []byte) (versionIndex, error) {
+	var idx versionIndex
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return versionIndex{}, fmt.Errorf("version index of %s: %w", name, err)
+		}
+		return idx, nil
+	}
+
+	// Earlier releases only listed the versions. The uploader of the oldest
+	// one kept is the best record of the owner they have.
+	if err := json.Unmarshal(data, &idx.Versions); err != nil {
+		return versionIndex{}, fmt.Errorf("version index of %s: %w", name, err)
+	}
+	idx.legacy = true
+	if len(idx.Versions) > 0 {
+		first := idx.Versions[0]
+		idx.Owner, idx.OwnerName, idx.Created = first.UploaderID, first.Uploader, first.Time
+	}
+	return idx, nil
+}
+
+// writeIndex replaces the version index of name.
+func (m *MessageServer) writeIndex(name string, idx versionIndex) error {
+	data, err := encodeIndex(idx)
+	if err != nil {
+		return err
+	}
+	return putBytes(m.storage, m.uploads.dir, versionKey(name), data)
+}
+
+// encodeIndex returns the content of a version index.
+func encodeIndex(idx versionIndex) ([]byte, error) {
+	return json.MarshalIndent(idx, "", "  ")
+}
+
+// fileIndexLocked returns the version index of the file called name, or an
+// os.ErrNotExist error if there is no such file. It is read from the
+// catalog, so storage is not accessed; the versions are copied and may be
+// changed by the caller. The caller must hold m.publishMutex.
+func (m *MessageServer) fileIndexLocked(name string) (versionIndex, error) {
+	idx, ok := m.catalog[name]
+	if !ok {
+		return versionIndex{}, os.ErrNotExist
+	}
+	idx.Versions = slices.Clone(idx.Versions)
+	return idx, nil
+}
+
+// updateIndexLocked applies the retention policy to the versions in idx
+// and replaces the version index of name, and its entry in the catalog,
+// with the result. References to the content of dropped versions are
+// released only once the index no longer lists them. The caller must hold
+// m.publishMutex.
+func (m *MessageServer) updateIndexLocked(name string, idx versionIndex) error {
+	versions := idx.Versions
+	idx.Versions = m.pruneVersions(versions)
+	if err := m.writeIndex(name, idx); err != nil {
+		return err
+	}
+	m.setCatalogLocked(name, idx)
+	m.saveCatalogLocked()
+	for _, v := range versions[:len(versions)-len(idx.Versions)] {
+		m.blobs.Unref(v.SHA256)
+	}
+	return nil
+}
+
+// pruneVersions applies the retention policy to versions and returns the
+// versions that are kept. Versions are dropped oldest first, and the
+// current (last) version is always kept.
+func (m *MessageServer) pruneVersions(versions []fileVersion) []fileVersion {
+	maxAge := time.Duration(m.config.VersionMaxAge)
+	for i, v := range versions[:len(versions)-1] {
+		tooMany := m.config.MaxVersions > 0 && len(versions)-i > m.config.MaxVersions
+		tooOld := maxAge > 0 && time.Since(v.Time) > maxAge
+		if !tooMany && !tooOld {
+			return versions[i:]
+		}
+	}
+	return versions[len(versions)-1:]
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// LoadFiles prepares the shared files at startup. Files that earlier
+// releases stored directly in the upload directory are moved into the blob
+// store, and so into the configured storage, the retention policy is
+// applied, references to every blob are counted so that unreferenced
+// content can be deleted, and the catalog is loaded. The versions are read
+// from the catalog sidecar, or from every version index if it is out of
+// date. It returns the number of shared files.
+func (m *MessageServer) LoadFiles() (int, error) {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	dir := m.config.UploadDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") || strings.Contains(name, ".part") {
+			continue
+		}
+		if err := m.importLegacyFileLocked(name); err != nil {
+			log.Printf("[WARN] Cannot move %s into the blob store: %v", name, err)
+			continue
+		}
+		log.Printf("Moved %s into the blob store", name)
+	}
+
+	objects, err := m.storage.List(versionsDirName + "/")
+	if err != nil {
+		return 0, err
+	}
+	indexes := make(map[string]StorageObject, len(objects))
+	for _, obj := range objects {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(obj.Key, versionsDirName+"/"), "/"+versionIndexFile)
+		if ok && !strings.Contains(name, "/") {
+			indexes[name] = obj
+		}
+	}
+	catalog := m.loadCatalog(indexes)
+	dirty := catalog == nil
+
+	files := 0
+	for name, index := range indexes {
+		idx, ok := catalog[name]
+		if !ok {
+			if idx, err = readIndex(m.storage, name); err != nil {
+				log.Printf("[WARN] %v", err)
+				continue
+			}
+		}
+		versions := idx.Versions
+		var kept []fileVersion
+		if len(versions) > 0 {
+			for _, v := range m.pruneVersions(versions) {
+				if err := m.blobs.Ref(v.SHA256); err != nil {
+					log.Printf("[WARN] Dropping version %d of %s: %v", v.Version, name, err)
+					continue
+				}
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			dirty = true
+			if err := m.storage.Delete(index.Key); err != nil {
+				log.Printf("Failed to remove version index of %s: %v", name, err)
+			}
+			os.RemoveAll(versionsDir(dir, name))
+			continue
+		}
+		// Versions stored before types were detected get one now
+		sniffed := false
+		for i := range kept {
+			if kept[i].MIME != "" {
+				continue
+			}
+			if kept[i].MIME, err = m.blobs.sniffBlob(kept[i].SHA256); err != nil {
+				log.Printf("[WARN] Cannot detect the type of version %d of %s: %v", kept[i].Version, name, err)
+				continue
+			}
+			sniffed = true
+		}
+		idx.Versions = kept
+		if len(kept) < len(versions) || sniffed || idx.legacy {
+			dirty = true
+			if err := m.writeIndex(name, idx); err != nil {
+				log.Printf("Failed to update version index of %s: %v", name, err)
+			}
+		}
+		m.setCatalogLocked(name, idx)
+		files++
+	}
+	if dirty {
+		m.saveCatalogLocked()
+	}
+
+	// Content of pruned versions was not referenced above and goes too
+	if _, removed := m.blobs.Sweep(); removed > 0 {
+		log.Printf("Removed %d unreferenced blobs", removed)
+	}
+	return files, nil
+}
+
+// importLegacyFileLocked moves a file stored directly in the upload
+// directory, and the older versions kept on disk next to its version
+// index, into the blob store. The index is written before the file is moved, so an
+// interrupted import is simply repeated on the next start. The caller must
+// hold m.publishMutex.
+func (m *MessageServer) importLegacyFileLocked(name string) error {
+	dir := m.config.UploadDir
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	var idx versionIndex
+	index := filepath.Join(versionsDir(dir, name), versionIndexFile)
+	if data, err := os.ReadFile(index); err == nil {
+		if idx, err = parseIndex(name, data); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(idx.Versions) == 0 {
+		idx.Created = info.ModTime().UTC()
+		idx.Versions = []fileVersion{{Version: 1, Time: idx.Created}}
+	}
+	versions := idx.Versions
+	current := versions[len(versions)-1]
+	current.Size, current.SHA256 = info.Size(), hash
+
+	var kept []fileVersion
+	for _, v := range versions[:len(versions)-1] {
+		old := legacyVersionPath(dir, name, v.Version)
+		if _, err := os.Stat(old); err == nil {
+			if v.SHA256 == "" {
+				if v.SHA256, err = hashFile(old); err != nil {
+					return err
+				}
+			}
+			if err := m.blobs.Store(old, v.SHA256); err != nil {
+				return err
+			}
+		}
+		if m.blobs.Has(v.SHA256, v.Size) {
+			kept = append(kept, v)
+		}
+	}
+	idx.Versions = append(kept, current)
+	if err := m.writeIndex(name, idx); err != nil {
+		return err
+	}
+	if _, local := m.storage.(*LocalStorage); !local {
+		// The index now lives in the object store
+		os.RemoveAll(versionsDir(dir, name))
+	}
+	return m.blobs.Store(path, hash)
+}
+
+// findFileVersion returns the given version of name, or its current
+// version if version is 0.
+func (m *MessageServer) findFileVersion(name string, version int) (fileVersion, error) {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+
+	idx, err := m.fileIndexLocked(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	versions := idx.Versions
+	v := versions[len(versions)-1]
+	if version == 0 || version == v.Version {
+		return v, nil
+	}
+	for _, old := range versions[:len(versions)-1] {
+		if old.Version == version {
+			return old, nil
+		}
+	}
+	return fileVersion{}, errVersionNotFound
+}
+
+// handleVersions lists the versions of a file, newest first.
+func handleVersions(server *MessageServer, client *Client, s *webtransport.Stream, hdr *fileStreamHeader) {
+	server.publishMutex.Lock()
+	idx, err := server.fileIndexLocked(hdr.Filename)
+	server.publishMutex.Unlock()
+	if err != nil {
+		writeJSONResult(s, map[string]string{"status": "error", "error": "file not found"})
+		return
+	}
+	versions := idx.Versions
+
+	list := make([]map[string]interface{}, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		list = append(list, versions[i].public())
+	}
+	log.Printf("[%s] Listing %d versions of %s", client.Name, len(list), hdr.Filename)
+	writeJSONResult(s, map[string]interface{}{
+		"status": "ok", "filename": hdr.Filename, "current": versions[len(versions)-1].Version, "versions": list,
+	})
+}